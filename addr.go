@@ -26,6 +26,13 @@ func (a *Addr) String() string {
 	}).String()
 }
 
+func (a *Addr) SessionID() uint32 {
+	if a.sess == nil {
+		return 0
+	}
+	return a.sess.config.SessionID
+}
+
 func fromNetAddr(netAddr net.Addr) *Addr {
 	addr := new(Addr)
 	switch a := netAddr.(type) {
@@ -61,3 +68,12 @@ type DualStackAddr struct {
 func (a *DualStackAddr) invalid() bool {
 	return !(pooh.IsIPv4(a.IP4) || pooh.IsIPv6(a.IP6)) || a.Port == 0
 }
+
+// PortRange returns the ports from first to last inclusive.
+func PortRange(first, last int) []int {
+	var ports []int
+	for port := first; port <= last; port++ {
+		ports = append(ports, port)
+	}
+	return ports
+}
@@ -17,3 +17,9 @@ func TestAddr_String(tt *testing.T) {
 		Zone: "",
 	}).String())
 }
+
+func TestPortRange(tt *testing.T) {
+	t := assert.New(tt)
+	t.Equal([]int{20000, 20001, 20002}, PortRange(20000, 20002))
+	t.Empty(PortRange(20002, 20000))
+}
@@ -1,7 +1,6 @@
 package mdp
 
 import (
-	"encoding/binary"
 	"math/rand"
 	"net"
 	"reflect"
@@ -16,15 +15,31 @@ func init() {
 }
 
 const (
-	sessionIDSize = 4
-	nodeIDSize    = 4
-	natTimeout    = 30 * time.Second
-	queueSize     = 1024
+	sessionIDSize        = 4
+	nodeIDSize           = 4
+	sequenceSize         = 4
+	natTimeout           = 30 * time.Second
+	queueSize            = 1024
+	dialTimeout          = 5 * time.Second
+	redialMinInterval    = 100 * time.Millisecond
+	redialMaxInterval    = 30 * time.Second
+	throughputWindow     = time.Second
+	probeTimeout         = 3 * time.Second
+	defaultProbeInterval = time.Second
+	quarantineInterval   = time.Second
+	maxWriteErrors       = 3
+	maxProbeLosses       = 3
+	defaultIdleTimeout   = 3 * natTimeout
+	closeTimeout         = 100 * time.Millisecond
+	closeRetries         = 3
+	defaultHopOverlap    = 3 * time.Second
+	hopCheckInterval     = 100 * time.Millisecond
 )
 
 type inputPacket struct {
 	Addr *Addr
 	Data []byte
+	buf  *[]byte
 }
 
 type Obfuscator interface {
@@ -61,32 +76,51 @@ func readStreamIDs(conn pooh.Conn) (sid, nid uint32, err error) {
 	return
 }
 
-func connIndex(conn net.Conn) uint64 {
-	switch local := conn.LocalAddr().(type) {
+// endpointKey identifies an endpoint in its session by its endpointIndex
+// and, on the server side, the full IP of the peer, so that the endpoints of
+// a peer bound to several local addresses stay apart even if they share a
+// port.
+type endpointKey struct {
+	ip    [net.IPv6len]byte
+	index uint64
+}
+
+func remoteKey(ip net.IP, index uint64) (k endpointKey) {
+	copy(k.ip[:], ip.To16())
+	k.index = index
+	return
+}
+
+func connIndex(conn net.Conn) endpointKey {
+	return addrIndex(conn.LocalAddr(), conn.RemoteAddr())
+}
+
+func addrIndex(localAddr, remoteAddr net.Addr) endpointKey {
+	switch local := localAddr.(type) {
 	case *net.TCPAddr:
-		remote := conn.RemoteAddr().(*net.TCPAddr)
-		return endpointIndex(
+		remote := remoteAddr.(*net.TCPAddr)
+		return remoteKey(remote.IP, endpointIndex(
 			pooh.IsIPv4(local.IP),
 			endpointTCP,
 			uint16(local.Port),
 			uint16(remote.Port),
-		)
+		))
 	case *net.UDPAddr:
-		remote := conn.RemoteAddr().(*net.UDPAddr)
-		return endpointIndex(
+		remote := remoteAddr.(*net.UDPAddr)
+		return remoteKey(remote.IP, endpointIndex(
 			pooh.IsIPv4(local.IP),
 			endpointUDP,
 			uint16(local.Port),
 			uint16(remote.Port),
-		)
+		))
 	case *icmdp.Addr:
-		remote := conn.RemoteAddr().(*icmdp.Addr)
-		return endpointIndex(
+		remote := remoteAddr.(*icmdp.Addr)
+		return remoteKey(remote.IP, endpointIndex(
 			pooh.IsIPv4(local.IP),
 			endpointICMDP,
 			local.Seq,
 			remote.ID, // mainly for icmdp server side to represent client port
-		)
+		))
 	default:
 		panic(reflect.TypeOf(local).String())
 	}
@@ -96,9 +130,16 @@ func forwardIndex(sid, nid uint32) uint64 {
 	return uint64(sid)<<32 + uint64(nid)
 }
 
-func readPacketIDs(p []byte) (sid, nid uint32, data []byte) {
-	pLen := len(p)
-	return binary.BigEndian.Uint32(p[pLen-4:]), binary.BigEndian.Uint32(p[pLen-8:]), data[:pLen-8]
+// backoff returns the redial delay before the given attempt, doubling from
+// redialMinInterval up to redialMaxInterval with half of it jittered.
+func backoff(attempt int) time.Duration {
+	d := redialMaxInterval
+	if attempt < 16 {
+		if b := redialMinInterval << uint(attempt); b < d {
+			d = b
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
 }
 
 func endpointIndex(ipv4 bool, typ endpointType, localPort, remotePort uint16) uint64 {
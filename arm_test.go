@@ -1,6 +1,7 @@
 package mdp
 
 import (
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -8,5 +9,61 @@ import (
 
 func TestForwardIndex(tt *testing.T) {
 	t := assert.New(tt)
-	t.Equal(uint64(0x100000002),forwardIndex(0x1,0x2))
-}
\ No newline at end of file
+	t.Equal(uint64(0x100000002), forwardIndex(0x1, 0x2))
+}
+
+func TestBackoff(tt *testing.T) {
+	t := assert.New(tt)
+	for attempt := 0; attempt < 100; attempt++ {
+		d := backoff(attempt)
+		t.GreaterOrEqual(int64(d), int64(redialMinInterval/2))
+		t.LessOrEqual(int64(d), int64(redialMaxInterval))
+	}
+	t.LessOrEqual(int64(backoff(0)), int64(redialMinInterval))
+}
+
+func TestDedupWindow(tt *testing.T) {
+	t := assert.New(tt)
+	w := new(dedupWindow)
+	t.True(w.accept(10))
+	t.False(w.accept(10))
+	t.True(w.accept(12))
+	t.True(w.accept(11))
+	t.False(w.accept(11))
+	t.True(w.accept(10 + dedupWindowSize))
+	t.False(w.accept(12))
+	t.True(w.accept(13))
+	// late copies behind the window are dropped
+	t.False(w.accept(1))
+	for seq := uint32(20 + dedupWindowSize); seq < 3000; seq++ {
+		t.True(w.accept(seq))
+	}
+	for seq := uint32(1); seq <= 1000; seq++ {
+		t.False(w.accept(seq))
+		t.True(w.accept(seq + 3000))
+	}
+	// a restarted peer counts from another random sequence
+	seq := uint32(4000)
+	restart := seq - dedupRestartDistance
+	t.True(w.accept(restart))
+	t.True(w.accept(restart + 1))
+	t.False(w.accept(restart))
+	// wrap around
+	w = new(dedupWindow)
+	t.True(w.accept(0xffffffff))
+	t.True(w.accept(1))
+	t.False(w.accept(0xffffffff))
+}
+
+func TestAddrIndex(tt *testing.T) {
+	t := assert.New(tt)
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	index := func(ip net.IP) endpointKey {
+		return addrIndex(local, &net.UDPAddr{IP: ip, Port: 2})
+	}
+	t.Equal(index(net.IPv4(127, 0, 0, 1)), index(net.ParseIP("127.0.0.1").To4()))
+	t.NotEqual(index(net.IPv4(127, 0, 0, 1)), index(net.IPv4(127, 0, 0, 2)))
+	t.Equal(endpointIndex(true, endpointUDP, 1, 2), index(net.IPv4(127, 0, 0, 1)).index)
+	// peers whose IPs a 16 bit hash would not tell apart
+	t.NotEqual(index(net.ParseIP("::1f")), index(net.ParseIP("::100")))
+}
@@ -0,0 +1,434 @@
+package mdp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/poohvpn/pooh"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Batched UDP I/O: the UDP listener and the client UDP endpoints read and
+// write their sockets by recvmmsg and sendmmsg where the platform has them,
+// and on Linux the kernel further coalesces the datagrams of a flow on reads
+// by UDP GRO and segments equally sized datagrams to a destination on writes
+// by UDP GSO. Where any of them is missing, datagrams take a system call of
+// their own as before. Obfuscated sockets are not batched, the obfuscator
+// sees every datagram.
+const (
+	batchSize = 32
+	// gsoMaxSegments and gsoMaxSize are the limits of a UDP GSO send
+	gsoMaxSegments = 64
+	gsoMaxSize     = 0xffff - 8 - 40
+	// groBufferSize fits a datagram coalesced by UDP GRO
+	groBufferSize = 0xffff
+)
+
+// batchReadWriter is implemented by ipv4.PacketConn and ipv6.PacketConn.
+type batchReadWriter interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// msgReader reads a batch into messages whose buffers are fixed, without
+// allocating the source address of every datagram as ReadBatch does.
+type msgReader interface {
+	readMsgs(msgs []ipv4.Message) (int, error)
+}
+
+var (
+	_ net.Conn       = &batchConn{}
+	_ net.PacketConn = &batchConn{}
+)
+
+// batchConn is a UDP socket read by readPackets and written in batches by
+// a writeLoop. Writes are queued, so the error of a write is returned by the
+// next one, while writeNow writes at once, such as probes whose errors
+// matter. Close flushes the queue before closing the socket.
+type batchConn struct {
+	*net.UDPConn
+	xconn batchReadWriter
+	// remote of a connected socket
+	remote net.Addr
+	// noRecvmmsg and noSendmmsg fall back to a system call per datagram
+	noRecvmmsg bool
+	noSendmmsg bool
+	gso        bool
+	gro        bool
+	writeCh    chan batchPacket
+	// runs and msgs are the scratch of the writeLoop
+	runs      [][]batchPacket
+	msgs      []ipv4.Message
+	errM      sync.Mutex
+	writeErr  error
+	done      chan struct{}
+	flushed   chan struct{}
+	closeOnce sync.Once
+}
+
+type batchPacket struct {
+	buf  *[]byte
+	addr net.Addr
+}
+
+func (p batchPacket) data() []byte {
+	return *p.buf
+}
+
+// batchable reports whether the UDP sockets obfuscated by ob can be batched.
+func batchable(ob Obfuscator) bool {
+	_, ok := ob.(nopObfuscator)
+	return ok
+}
+
+// newBatchConn wraps conn, which is connected to remote unless it is nil.
+func newBatchConn(conn *net.UDPConn, remote net.Addr) *batchConn {
+	c := &batchConn{
+		UDPConn: conn,
+		remote:  remote,
+		writeCh: make(chan batchPacket, queueSize),
+		done:    make(chan struct{}),
+		flushed: make(chan struct{}),
+	}
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok && pooh.IsIPv4(local.IP) {
+		c.xconn = ipv4.NewPacketConn(conn)
+	} else {
+		c.xconn = ipv6.NewPacketConn(conn)
+	}
+	c.gso, c.gro = enableOffload(conn)
+	go c.writeLoop()
+	return c
+}
+
+// readPackets passes every received datagram with its source address to
+// handle, which must not retain it, until handle returns false or the
+// socket fails.
+func (c *batchConn) readPackets(handle func(p []byte, addr net.Addr) bool) error {
+	bufSize := pooh.BufferSize
+	if c.gro {
+		bufSize = groBufferSize
+	}
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, bufSize)}
+		if c.gro {
+			msgs[i].OOB = make([]byte, groOOBSize)
+		}
+	}
+	reader := newMsgReader(c.UDPConn, c.remote != nil, msgs)
+	for {
+		n, err := c.readBatch(reader, msgs)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs[:n] {
+			p := m.Buffers[0][:m.N]
+			addr := m.Addr
+			if addr == nil {
+				addr = c.remote
+			}
+			size := len(p)
+			if c.gro {
+				if s := groSegmentSize(m.OOB[:m.NN]); s > 0 {
+					size = s
+				}
+			}
+			for len(p) > 0 {
+				segment := p
+				if len(segment) > size {
+					segment = segment[:size]
+				}
+				p = p[len(segment):]
+				if !handle(segment, addr) {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (c *batchConn) readBatch(reader msgReader, msgs []ipv4.Message) (int, error) {
+	if !c.noRecvmmsg {
+		var n int
+		var err error
+		if reader != nil {
+			n, err = reader.readMsgs(msgs)
+		} else {
+			n, err = c.xconn.ReadBatch(msgs, 0)
+		}
+		if !errors.Is(err, syscall.ENOSYS) {
+			return n, err
+		}
+		// the kernel lacks recvmmsg
+		c.noRecvmmsg = true
+	}
+	m := &msgs[0]
+	var err error
+	m.N, m.NN, _, m.Addr, err = c.UDPConn.ReadMsgUDP(m.Buffers[0], m.OOB)
+	if err != nil {
+		return 0, err
+	}
+	if c.remote != nil {
+		m.Addr = nil
+	}
+	return 1, nil
+}
+
+// Write queues p on a connected socket.
+func (c *batchConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, nil)
+}
+
+// WriteTo queues p to addr, or to the remote of a connected socket if addr
+// is nil.
+func (c *batchConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.writeToTimeout(p, addr, nil)
+}
+
+func (c *batchConn) writeTimeout(p []byte, timeout <-chan struct{}) (int, error) {
+	return c.writeToTimeout(p, nil, timeout)
+}
+
+// writeToTimeout is WriteTo failing once timeout is closed while the queue
+// is full.
+func (c *batchConn) writeToTimeout(p []byte, addr net.Addr, timeout <-chan struct{}) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	if err := c.takeWriteErr(); err != nil {
+		return 0, err
+	}
+	if c.remote != nil {
+		addr = nil
+	}
+	buf := getBuffer(len(p))
+	copy(*buf, p)
+	select {
+	case c.writeCh <- batchPacket{
+		buf:  buf,
+		addr: addr,
+	}:
+		return len(p), nil
+	case <-c.done:
+		putBuffer(buf)
+		return 0, net.ErrClosed
+	case <-timeout:
+		putBuffer(buf)
+		return 0, timeoutError{}
+	}
+}
+
+// writeNowTo writes p to addr, or to the remote of a connected socket if addr
+// is nil, bypassing the queue.
+func (c *batchConn) writeNowTo(p []byte, addr net.Addr) (int, error) {
+	if c.remote != nil || addr == nil {
+		return c.UDPConn.Write(p)
+	}
+	return c.UDPConn.WriteTo(p, addr)
+}
+
+func (c *batchConn) writeNow(p []byte) (int, error) {
+	return c.writeNowTo(p, nil)
+}
+
+func (c *batchConn) takeWriteErr() error {
+	c.errM.Lock()
+	defer c.errM.Unlock()
+	err := c.writeErr
+	c.writeErr = nil
+	return err
+}
+
+func (c *batchConn) setWriteErr(err error) {
+	c.errM.Lock()
+	defer c.errM.Unlock()
+	c.writeErr = err
+}
+
+func (c *batchConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		select {
+		case <-c.flushed:
+		case <-time.After(closeTimeout):
+		}
+	})
+	return c.UDPConn.Close()
+}
+
+// writeLoop sends the queued datagrams, as many at once as are queued,
+// and flushes the queue once closed.
+func (c *batchConn) writeLoop() {
+	defer close(c.flushed)
+	packets := make([]batchPacket, 0, batchSize)
+	for {
+		select {
+		case p := <-c.writeCh:
+			c.writeQueued(append(packets[:0], p))
+		case <-c.done:
+			for c.writeQueued(packets[:0]) {
+			}
+			return
+		}
+	}
+}
+
+// writeQueued sends packets with as many queued ones as fit in a batch, and
+// reports whether there were any.
+func (c *batchConn) writeQueued(packets []batchPacket) bool {
+drain:
+	for len(packets) < batchSize {
+		select {
+		case p := <-c.writeCh:
+			packets = append(packets, p)
+		default:
+			break drain
+		}
+	}
+	if len(packets) == 0 {
+		return false
+	}
+	c.writePackets(packets)
+	for i := range packets {
+		putBuffer(packets[i].buf)
+		packets[i] = batchPacket{}
+	}
+	return true
+}
+
+// writePackets sends packets by a batch of messages, each of which carries a
+// run of packets to the same address by UDP GSO if it is enabled.
+func (c *batchConn) writePackets(packets []batchPacket) {
+	runs := c.runs[:0]
+	if c.gso {
+		runs = gsoRuns(runs, packets)
+	} else {
+		for i := range packets {
+			runs = append(runs, packets[i:i+1])
+		}
+	}
+	c.runs = runs
+	if cap(c.msgs) < len(runs) {
+		c.msgs = make([]ipv4.Message, len(runs))
+	}
+	msgs := c.msgs[:len(runs)]
+	for i, run := range runs {
+		runMessage(&msgs[i], run)
+	}
+	for i := 0; i < len(msgs); {
+		n, err := c.writeBatch(msgs[i:])
+		i += n
+		if err == nil {
+			continue
+		}
+		if run := runs[i]; len(run) > 1 {
+			// GSO failed, such as without checksum offload on the device,
+			// so it is disabled unless the packets fail on their own too
+			c.gso = false
+			for j := range run {
+				runMessage(&msgs[i], run[j:j+1])
+				if _, err := c.writeBatch(msgs[i : i+1]); err != nil {
+					c.gso = true
+					c.setWriteErr(err)
+				}
+			}
+		} else {
+			c.setWriteErr(err)
+		}
+		i++
+	}
+	for i := range msgs {
+		msgs[i].Addr = nil
+	}
+}
+
+func (c *batchConn) writeBatch(msgs []ipv4.Message) (int, error) {
+	if !c.noSendmmsg {
+		n, err := c.xconn.WriteBatch(msgs, 0)
+		if n < 0 {
+			// the result of the failed system call
+			n = 0
+		}
+		if !errors.Is(err, syscall.ENOSYS) {
+			return n, err
+		}
+		// the kernel lacks sendmmsg
+		c.noSendmmsg = true
+	}
+	m := &msgs[0]
+	var addr *net.UDPAddr
+	if m.Addr != nil {
+		addr = m.Addr.(*net.UDPAddr)
+	}
+	buf := m.Buffers[0]
+	if len(m.Buffers) > 1 {
+		buf = nil
+		for _, b := range m.Buffers {
+			buf = append(buf, b...)
+		}
+	}
+	if _, _, err := c.UDPConn.WriteMsgUDP(buf, m.OOB, addr); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// gsoRuns appends the runs of packets for UDP GSO to runs, which are to the
+// same address and of the same size but the last one, which may be shorter.
+func gsoRuns(runs [][]batchPacket, packets []batchPacket) [][]batchPacket {
+	start, total := 0, 0
+	for i, p := range packets {
+		if i > start {
+			run := packets[start:i]
+			size := len(run[0].data())
+			if !sameAddr(p.addr, run[0].addr) ||
+				len(run[len(run)-1].data()) != size ||
+				len(p.data()) > size ||
+				len(run) == gsoMaxSegments ||
+				total+len(p.data()) > gsoMaxSize {
+				runs = append(runs, run)
+				start, total = i, 0
+			}
+		}
+		total += len(p.data())
+	}
+	if start < len(packets) {
+		runs = append(runs, packets[start:])
+	}
+	return runs
+}
+
+// runMessage sets m to the message of a run of packets, whose size is the
+// segment size of UDP GSO, reusing the buffers of m.
+func runMessage(m *ipv4.Message, run []batchPacket) {
+	m.Addr = run[0].addr
+	m.Buffers = m.Buffers[:0]
+	for _, p := range run {
+		m.Buffers = append(m.Buffers, p.data())
+	}
+	m.OOB = m.OOB[:0]
+	if len(run) > 1 {
+		m.OOB = gsoOOB(m.OOB, len(run[0].data()))
+	}
+}
+
+func sameAddr(a, b net.Addr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	ua, ok := a.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	ub, ok := b.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	return ua.Port == ub.Port && ua.Zone == ub.Zone && ua.IP.Equal(ub.IP)
+}
@@ -0,0 +1,112 @@
+package mdp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGSORuns(tt *testing.T) {
+	t := require.New(tt)
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	b := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	packet := func(size int, addr net.Addr) batchPacket {
+		b := make([]byte, size)
+		return batchPacket{buf: &b, addr: addr}
+	}
+	lens := func(runs [][]batchPacket) (l []int) {
+		for _, run := range runs {
+			l = append(l, len(run))
+		}
+		return
+	}
+	t.Equal([]int{3, 1}, lens(gsoRuns(nil, []batchPacket{
+		packet(100, a), packet(100, a), packet(50, a), packet(50, a),
+	})), "a shorter segment ends the run")
+	t.Equal([]int{2, 2}, lens(gsoRuns(nil, []batchPacket{
+		packet(100, a), packet(100, a), packet(100, b), packet(100, b),
+	})), "by address")
+	t.Equal([]int{1, 1}, lens(gsoRuns(nil, []batchPacket{
+		packet(50, a), packet(100, a),
+	})), "larger segment")
+
+	var packets []batchPacket
+	for i := 0; i < gsoMaxSegments+1; i++ {
+		packets = append(packets, packet(100, nil))
+	}
+	t.Equal([]int{gsoMaxSegments, 1}, lens(gsoRuns(nil, packets)))
+	packets = packets[:0]
+	for i := 0; i < 60; i++ {
+		packets = append(packets, packet(basePathMTU, nil))
+	}
+	runs := gsoRuns(nil, packets)
+	t.Len(runs, 2)
+	t.LessOrEqual(len(runs[0])*basePathMTU, gsoMaxSize)
+}
+
+func TestBatchConn(tt *testing.T) {
+	t := require.New(tt)
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		t.NoError(err)
+		return conn
+	}
+	receiver := newBatchConn(listen(), nil)
+	defer receiver.Close()
+	conn, err := net.DialUDP("udp4", nil, receiver.LocalAddr().(*net.UDPAddr))
+	t.NoError(err)
+	sender := newBatchConn(conn, conn.RemoteAddr())
+	defer sender.Close()
+
+	// bursts of equally sized datagrams are segmented and coalesced by the
+	// kernel if it supports UDP GSO and GRO
+	var sent [][]byte
+	for i := 0; i < 64; i++ {
+		size := basePathMTU
+		if i%10 == 9 {
+			size = 100 + i
+		}
+		p := bytes.Repeat([]byte{byte(i)}, size)
+		sent = append(sent, p)
+		_, err = sender.Write(p)
+		t.NoError(err)
+	}
+
+	var received [][]byte
+	t.NoError(receiver.SetReadDeadline(time.Now().Add(2 * time.Second)))
+	_ = receiver.readPackets(func(p []byte, addr net.Addr) bool {
+		t.True(sameAddr(sender.LocalAddr(), addr))
+		received = append(received, append([]byte(nil), p...))
+		return len(received) < len(sent)
+	})
+	t.Equal(sent, received)
+
+	// and back to the source address
+	_, err = receiver.WriteTo([]byte("pong"), sender.LocalAddr())
+	t.NoError(err)
+	t.NoError(sender.SetReadDeadline(time.Now().Add(2 * time.Second)))
+	_ = sender.readPackets(func(p []byte, addr net.Addr) bool {
+		t.Equal("pong", string(p))
+		t.Equal(receiver.LocalAddr().String(), addr.String())
+		return false
+	})
+
+	// writeNow returns its own error instead of the next write
+	_, err = sender.writeNow(make([]byte, 70000))
+	t.Error(err)
+	_, err = sender.Write([]byte("last"))
+	t.NoError(err)
+
+	// what is queued is flushed by Close
+	t.NoError(sender.Close())
+	_, err = sender.Write([]byte("closed"))
+	t.Equal(net.ErrClosed, err)
+	t.NoError(receiver.SetReadDeadline(time.Now().Add(2 * time.Second)))
+	t.NoError(receiver.readPackets(func(p []byte, addr net.Addr) bool {
+		t.Equal("last", string(p))
+		return false
+	}))
+}
@@ -0,0 +1,89 @@
+package mdp
+
+import "sync"
+
+// Packet buffers are pooled in two size classes. Whoever holds a buffer owns
+// it until passing it on or putting it back exactly once:
+//
+//   - read buffers are only lent to endpoint.recv, what outlives the call,
+//     such as FEC and fragment payloads, is copied;
+//   - accepted datagrams are copied into pooled inputPackets, which the
+//     reader of the input channel releases once it has copied them out;
+//   - frames are marshalled into pooled buffers, which conns must not retain
+//     after Write returns.
+//
+// Buffers beyond largeBufferSize, such as of reassembled datagrams, are
+// allocated and left to the garbage collector. The source addresses of
+// batched reads are cached per peer on Linux, elsewhere they are allocated
+// per datagram by golang.org/x/net.
+const (
+	// smallBufferSize fits a frame of any UDP or ICMDP path
+	smallBufferSize = 2048
+	// largeBufferSize fits a frame of the TCP path with its length prefix
+	largeBufferSize = 2 + tcpPathMTU
+)
+
+var (
+	smallBuffers = sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, smallBufferSize)
+			return &b
+		},
+	}
+	largeBuffers = sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, largeBufferSize)
+			return &b
+		},
+	}
+	inputPackets = sync.Pool{
+		New: func() interface{} {
+			return new(inputPacket)
+		},
+	}
+)
+
+// getBuffer returns a buffer of n bytes.
+func getBuffer(n int) *[]byte {
+	var b *[]byte
+	switch {
+	case n <= smallBufferSize:
+		b = smallBuffers.Get().(*[]byte)
+	case n <= largeBufferSize:
+		b = largeBuffers.Get().(*[]byte)
+	default:
+		buf := make([]byte, n)
+		return &buf
+	}
+	*b = (*b)[:n]
+	return b
+}
+
+// putBuffer puts b back to its pool, it must not be used afterwards.
+func putBuffer(b *[]byte) {
+	switch cap(*b) {
+	case smallBufferSize:
+		smallBuffers.Put(b)
+	case largeBufferSize:
+		largeBuffers.Put(b)
+	}
+}
+
+// newInputPacket returns a pooled inputPacket of a copy of data.
+func newInputPacket(addr *Addr, data []byte) *inputPacket {
+	p := inputPackets.Get().(*inputPacket)
+	p.Addr = addr
+	p.buf = getBuffer(len(data))
+	p.Data = *p.buf
+	copy(p.Data, data)
+	return p
+}
+
+// release puts p back to the pool once its Data is consumed.
+func (p *inputPacket) release() {
+	putBuffer(p.buf)
+	p.Addr = nil
+	p.Data = nil
+	p.buf = nil
+	inputPackets.Put(p)
+}
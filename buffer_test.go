@@ -0,0 +1,81 @@
+package mdp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferPool(tt *testing.T) {
+	t := require.New(tt)
+	for _, n := range []int{0, 100, smallBufferSize, smallBufferSize + 1, largeBufferSize, largeBufferSize + 1} {
+		b := getBuffer(n)
+		t.Len(*b, n)
+		putBuffer(b)
+	}
+
+	p := newInputPacket(nil, []byte("data"))
+	t.Equal([]byte("data"), p.Data)
+	p.release()
+	t.Nil(p.Data)
+}
+
+// benchmarkRoundTrip measures datagrams echoed by the server to the client.
+func benchmarkRoundTrip(b *testing.B, config Config) {
+	t := require.New(b)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:                     port,
+		DisableICMDP:             true,
+		DisableCongestionControl: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+	go echo(server)
+
+	config.IP4 = net.IPv4(127, 0, 0, 1)
+	config.Port = port
+	config.DisableICMDP = true
+	config.DisableCongestionControl = true
+	config.ProbeInterval = -1
+	client, err := NewClient(config)
+	t.NoError(err)
+	defer client.Close()
+	waitPaths(t, client, 1)
+
+	data := make([]byte, 1000)
+	buf := make([]byte, 2000)
+	roundTrip := func() {
+		_, err := client.Write(data)
+		t.NoError(err)
+		_, err = client.Read(buf)
+		t.NoError(err)
+	}
+	// a datagram is hardly lost in a single round trip on the loopback
+	t.NoError(client.SetReadDeadline(time.Now().Add(time.Minute)))
+	// warm up the sessions and pools
+	for i := 0; i < 100; i++ {
+		roundTrip()
+	}
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		roundTrip()
+	}
+}
+
+func BenchmarkRoundTripUDP(b *testing.B) {
+	benchmarkRoundTrip(b, Config{
+		DisableTCP: true,
+	})
+}
+
+func BenchmarkRoundTripTCP(b *testing.B) {
+	benchmarkRoundTrip(b, Config{
+		DisableUDP: true,
+	})
+}
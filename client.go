@@ -4,39 +4,92 @@ import (
 	"errors"
 	"net"
 	"time"
+
+	"github.com/poohvpn/pooh"
 )
 
 var _ net.Conn = &Client{}
 
+var errClientClosed = errors.New("mdp: client is closed")
+
 func NewClient(config Config) (*Client, error) {
+	config.def()
+	remote := config.dualStackAddr()
+	if remote.invalid() {
+		return nil, errors.New("mdp: invalid remote address")
+	}
+	ip := remote.IP4
+	if !pooh.IsIPv4(ip) {
+		ip = remote.IP6
+	}
 	c := &Client{
-		sess: newSession(config).addForwardEndpoints(),
+		sess: newSession(config).
+			setForwardAddr(&net.UDPAddr{
+				IP:   ip,
+				Port: remote.Port,
+				Zone: remote.Zone,
+			}).
+			setAcceptCh(nil).
+			addForwardEndpoints(),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
 	}
 	return c, nil
 }
 
 type Client struct {
-	sess *session
+	sess          *session
+	readDeadline  *deadline
+	writeDeadline *deadline
 }
 
 func (c *Client) Read(b []byte) (n int, err error) {
 	select {
 	case <-c.sess.closeOnce.Wait():
-		return 0, errors.New("mdp: client is closed")
+		return 0, c.sess.closeError(errClientClosed)
+	case <-c.readDeadline.wait():
+		return 0, timeoutError{}
 	case packet := <-c.sess.dstInputCh:
 		n = copy(b, packet.Data)
+		packet.release()
 		return
 	}
 }
 
 func (c *Client) Write(b []byte) (n int, err error) {
-	return len(b), c.sess.output(b,true)
+	if c.sess.closeOnce.Done() {
+		return 0, c.sess.closeError(errClientClosed)
+	}
+	if c.writeDeadline.exceeded() {
+		return 0, timeoutError{}
+	}
+	return len(b), c.sess.output(b, true, c.writeDeadline.wait())
 }
 
+// Close tells the server to close the session before closing the client.
 func (c *Client) Close() error {
+	if !c.sess.closeOnce.Done() {
+		c.sess.shutdown(true)
+	}
 	return c.sess.Close()
 }
 
+// OpenStream opens a new reliable ordered Stream multiplexed over the
+// session, which the server accepts by Server.AcceptStream.
+func (c *Client) OpenStream() (*Stream, error) {
+	return c.sess.openStream(true)
+}
+
+// AcceptStream waits for the next Stream opened by Server.OpenStream.
+func (c *Client) AcceptStream() (*Stream, error) {
+	select {
+	case <-c.sess.closeOnce.Wait():
+		return nil, c.sess.closeError(errClientClosed)
+	case st := <-c.sess.acceptCh:
+		return st, nil
+	}
+}
+
 func (c *Client) LocalAddr() net.Addr {
 	return c.sess.srcAddr
 }
@@ -45,14 +98,33 @@ func (c *Client) RemoteAddr() net.Addr {
 	return c.sess.dstAddr
 }
 
+func (c *Client) SessionID() uint32 {
+	return c.sess.config.SessionID
+}
+
+// MaxDatagramSize returns the largest datagram sent without fragmentation,
+// as limited by FragmentSize and the path MTU discovered by probing.
+func (c *Client) MaxDatagramSize() int {
+	return c.sess.maxDatagramSize(true)
+}
+
+// Paths returns the connected endpoints of the client with their measurements.
+func (c *Client) Paths() []Path {
+	return c.sess.paths(true)
+}
+
 func (c *Client) SetDeadline(t time.Time) error {
-	panic("implement me")
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
 }
 
 func (c *Client) SetReadDeadline(t time.Time) error {
-	panic("implement me")
+	c.readDeadline.set(t)
+	return nil
 }
 
 func (c *Client) SetWriteDeadline(t time.Time) error {
-	panic("implement me")
+	c.writeDeadline.set(t)
+	return nil
 }
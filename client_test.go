@@ -2,9 +2,13 @@ package mdp
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
+	"os"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -27,3 +31,353 @@ func TestClient(tt *testing.T) {
 	fmt.Println("client SessionID:", client.SessionID())
 	t.NoError(client.Close())
 }
+
+func freePort(t *require.Assertions) int {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	t.NoError(err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// waitPaths waits for n endpoints of the client to connect, TCP ones are
+// dialed in the background.
+func waitPaths(t *require.Assertions, client *Client, n int) {
+	t.Eventually(func() bool {
+		return len(client.Paths()) == n
+	}, time.Second, 10*time.Millisecond)
+}
+
+// testObfuscator impairs the datagrams written by clients: those larger than
+// mtu fail like on a socket with the don't fragment bit, and those for which
+// drop returns true are lost.
+type testObfuscator struct {
+	nopObfuscator
+	mtu  int
+	drop func(p []byte) bool
+}
+
+func (o testObfuscator) ObfuscateDatagramConn(conn net.Conn) net.Conn {
+	return &testConn{Conn: conn, o: o}
+}
+
+type testConn struct {
+	net.Conn
+	o testObfuscator
+}
+
+func (c *testConn) Write(p []byte) (int, error) {
+	if c.o.mtu > 0 && len(p) > c.o.mtu {
+		return 0, syscall.EMSGSIZE
+	}
+	if c.o.drop != nil && c.o.drop(p) {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+// dropRandom loses a fraction of the datagrams.
+func dropRandom(loss float64) func(p []byte) bool {
+	return func(p []byte) bool {
+		return rand.Float64() < loss
+	}
+}
+
+// dropFrames loses the frames for which drop returns true.
+func dropFrames(drop func(h header) bool) func(p []byte) bool {
+	return func(p []byte) bool {
+		h, _, err := parseFrame(p)
+		return err == nil && drop(h)
+	}
+}
+
+func echo(server *Server) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := server.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		_, _ = server.WriteTo(buf[:n], addr)
+	}
+}
+
+func TestClientRedial(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	client, err := NewClient(Config{
+		IP4:          net.IPv4(127, 0, 0, 1),
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer client.Close()
+
+	// server is started after the client, so endpoints have to redial
+	time.Sleep(300 * time.Millisecond)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+	go echo(server)
+
+	received := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 65536)
+		n, err := client.Read(buf)
+		if err == nil {
+			received <- buf[:n]
+		}
+	}()
+	msg := []byte("hello world")
+	for i := 0; ; i++ {
+		_, _ = client.Write(msg)
+		select {
+		case data := <-received:
+			t.Equal(msg, data)
+			return
+		case <-time.After(200 * time.Millisecond):
+			t.Less(i, 50, "client never reconnected")
+		}
+	}
+}
+
+func TestClientDeadline(tt *testing.T) {
+	t := require.New(tt)
+	client, err := NewClient(Config{
+		IP4:          net.IPv4(127, 0, 0, 1),
+		Port:         freePort(t),
+		DisableTCP:   true,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer client.Close()
+
+	t.NoError(client.SetReadDeadline(time.Now().Add(50 * time.Millisecond)))
+	_, err = client.Read(make([]byte, 10))
+	netErr, ok := err.(net.Error)
+	t.True(ok)
+	t.True(netErr.Timeout())
+
+	t.NoError(client.SetWriteDeadline(time.Now().Add(-time.Second)))
+	_, err = client.Write([]byte("data"))
+	netErr, ok = err.(net.Error)
+	t.True(ok)
+	t.True(netErr.Timeout())
+}
+
+// fixedRate is a congestion control pacing at its bytes per second.
+type fixedRate float64
+
+func (fixedRate) OnFeedback(sent, delivered int, rtt time.Duration) {}
+
+func (r fixedRate) PacingRate() float64 { return float64(r) }
+
+func TestClientDeadlinePacing(tt *testing.T) {
+	t := require.New(tt)
+	client, err := NewClient(Config{
+		IP4:          net.IPv4(127, 0, 0, 1),
+		Port:         freePort(t),
+		DisableTCP:   true,
+		DisableICMDP: true,
+		CongestionControl: func() CongestionControl {
+			return fixedRate(1000)
+		},
+	})
+	t.NoError(err)
+	defer client.Close()
+
+	// a write blocked by pacing fails at the deadline rather than after it
+	t.NoError(client.SetWriteDeadline(time.Now().Add(100 * time.Millisecond)))
+	start := time.Now()
+	for err == nil {
+		_, err = client.Write(make([]byte, 1000))
+	}
+	t.ErrorIs(err, os.ErrDeadlineExceeded)
+	t.Less(time.Since(start), 500*time.Millisecond)
+}
+
+func TestClientRedundancy(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+		Redundancy:   2,
+	})
+	t.NoError(err)
+	defer server.Close()
+	go echo(server)
+
+	client, err := NewClient(Config{
+		IP4:          net.IPv4(127, 0, 0, 1),
+		Port:         port,
+		DisableICMDP: true,
+		Redundancy:   2,
+	})
+	t.NoError(err)
+	defer client.Close()
+	time.Sleep(100 * time.Millisecond) // wait for the server to accept tcp
+
+	for i := 0; i < 5; i++ {
+		_, err = client.Write([]byte{byte(i)})
+		t.NoError(err)
+	}
+	buf := make([]byte, 10)
+	received := make(map[byte]int)
+	t.NoError(client.SetReadDeadline(time.Now().Add(500 * time.Millisecond)))
+	for {
+		n, err := client.Read(buf)
+		if err != nil {
+			break
+		}
+		t.Equal(1, n)
+		received[buf[0]]++
+	}
+	t.Equal(map[byte]int{0: 1, 1: 1, 2: 1, 3: 1, 4: 1}, received)
+}
+
+func TestClientKeepalive(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		IP4:               net.IPv4(127, 0, 0, 1),
+		Port:              port,
+		DisableICMDP:      true,
+		KeepaliveInterval: 100 * time.Millisecond,
+	})
+	t.NoError(err)
+	defer client.Close()
+
+	time.Sleep(300 * time.Millisecond)
+	client.sess.dstEndpoints.Range(func(_, v interface{}) bool {
+		ep := v.(*endpoint)
+		t.False(ep.LastSent().IsZero(), ep.Network())
+		t.WithinDuration(time.Now(), ep.LastRecv(), 200*time.Millisecond, ep.Network())
+		return true
+	})
+
+	// keepalives never reach the application
+	t.NoError(server.SetReadDeadline(time.Now().Add(50 * time.Millisecond)))
+	_, _, err = server.ReadFrom(make([]byte, 10))
+	t.Error(err)
+}
+
+func TestClientProbe(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		IP4:           net.IPv4(127, 0, 0, 1),
+		Port:          port,
+		DisableICMDP:  true,
+		ProbeInterval: 50 * time.Millisecond,
+	})
+	t.NoError(err)
+	defer client.Close()
+
+	time.Sleep(300 * time.Millisecond)
+	paths := client.Paths()
+	t.Len(paths, 2)
+	for _, p := range paths {
+		t.Greater(int64(p.RTT()), int64(0), p.Network())
+		t.Less(int64(p.RTT()), int64(100*time.Millisecond), p.Network())
+		t.Zero(p.Loss(), p.Network())
+	}
+}
+
+func TestClientLocalAddrs(tt *testing.T) {
+	t := require.New(tt)
+	var loopback string
+	ifis, err := net.Interfaces()
+	t.NoError(err)
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagLoopback != 0 {
+			loopback = ifi.Name
+		}
+	}
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+	go echo(server)
+
+	client, err := NewClient(Config{
+		IP4:          net.IPv4(127, 0, 0, 1),
+		Port:         port,
+		DisableICMDP: true,
+		DisableTCP:   true,
+		Redundancy:   3,
+		// ::1 is skipped for the IPv4 server
+		LocalAddrs: []string{"127.0.0.1", "127.0.0.2", "::1", loopback},
+	})
+	t.NoError(err)
+	defer client.Close()
+	locals := make(map[string]int)
+	for _, p := range client.Paths() {
+		locals[p.LocalAddr().(*net.UDPAddr).IP.String()]++
+	}
+	t.Equal(map[string]int{"127.0.0.1": 2, "127.0.0.2": 1}, locals)
+
+	_, err = client.Write([]byte("hello"))
+	t.NoError(err)
+	t.NoError(client.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = client.Read(make([]byte, 10))
+	t.NoError(err)
+	// the server tells the endpoints apart
+	t.Eventually(func() bool {
+		n := 0
+		server.rangeSessions(func(sess *session) {
+			n += len(sess.paths(false))
+		})
+		return n == 3
+	}, time.Second, 10*time.Millisecond)
+
+	// an unknown interface is redialed until it shows up
+	client, err = NewClient(Config{
+		IP4:          net.IPv4(127, 0, 0, 1),
+		Port:         port,
+		DisableICMDP: true,
+		LocalAddrs:   []string{"mdp-none0"},
+	})
+	t.NoError(err)
+	defer client.Close()
+	t.Empty(client.Paths())
+}
+
+func TestClientDialsTCPInBackground(tt *testing.T) {
+	t := require.New(tt)
+	start := time.Now()
+	client, err := NewClient(Config{
+		IP4:          net.IPv4(127, 0, 0, 1),
+		Port:         freePort(t),
+		DisableUDP:   true,
+		DisableICMDP: true,
+		Threads:      4,
+		// as a handshake which takes long
+		Control: func(network, address string, c syscall.RawConn) error {
+			time.Sleep(500 * time.Millisecond)
+			return nil
+		},
+	})
+	t.NoError(err)
+	defer client.Close()
+	t.Less(int64(time.Since(start)), int64(100*time.Millisecond))
+}
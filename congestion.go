@@ -0,0 +1,199 @@
+package mdp
+
+import (
+	"math"
+	"time"
+)
+
+// CongestionControl controls the sending rate of a UDP or ICMDP path from
+// the feedback of the peer, which answers every probe of the path with the
+// number of frames it has received on it. It is used by one endpoint and
+// never concurrently.
+type CongestionControl interface {
+	// OnFeedback is called when the peer reports that delivered of the sent
+	// frames since the last feedback have arrived, rtt is the round trip
+	// time sample of the report.
+	OnFeedback(sent, delivered int, rtt time.Duration)
+	// PacingRate returns the bytes per second to send at.
+	PacingRate() float64
+}
+
+const (
+	// congestionFeedbackInterval is how often busy endpoints probe for
+	// feedback when congestion control is enabled
+	congestionFeedbackInterval = 100 * time.Millisecond
+	// pacerBurst is the duration of sending at the pacing rate that the
+	// pacer allows in a burst
+	pacerBurst = 5 * time.Millisecond
+	// minPacingRate keeps a path usable after heavy losses
+	minPacingRate = 64 << 10
+)
+
+// cubic constants of RFC 8312
+const (
+	cubicC          = 0.4
+	cubicBeta       = 0.7
+	cubicSegment    = basePathMTU
+	cubicInitWindow = 32
+	cubicMinWindow  = 4
+	cubicMaxWindow  = 1 << 16
+	// cubicInitRTT is assumed until the RTT is measured
+	cubicInitRTT = 100 * time.Millisecond
+	// cubicLossTolerance ignores random loss up to that rate
+	cubicLossTolerance = 0.02
+	// cubicPacingGain paces faster than the window to probe for bandwidth
+	cubicPacingGain = 1.25
+)
+
+// pace waits for the pacer of the endpoint to send n bytes, or fails once
+// timeout is closed.
+func (e *endpoint) pace(n int, timeout <-chan struct{}) error {
+	if e.cc == nil {
+		return nil
+	}
+	e.statM.Lock()
+	d := e.pacer.wait(n, e.cc.PacingRate())
+	e.statM.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-timeout:
+		return timeoutError{}
+	}
+}
+
+// feedback passes the report of the peer that it has received peerRecv
+// frames, when sent frames had been sent, to the congestion control.
+func (e *endpoint) feedback(sent, peerRecv int, rtt time.Duration) {
+	if e.cc == nil {
+		return
+	}
+	if e.feedbackValid && (sent < e.feedbackSent || peerRecv < e.feedbackRecv) {
+		// reordered reports
+		return
+	}
+	if e.feedbackValid {
+		e.cc.OnFeedback(sent-e.feedbackSent, peerRecv-e.feedbackRecv, rtt)
+	}
+	e.feedbackValid = true
+	e.feedbackSent = sent
+	e.feedbackRecv = peerRecv
+}
+
+// resetFeedback forgets the reports on the conn of the endpoint, which is
+// broken, as the peer counts the frames on the redialled one afresh.
+func (e *endpoint) resetFeedback() {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	e.feedbackValid = false
+}
+
+// busy reports whether anything but probes has been sent since the last probe.
+func (e *endpoint) busy() bool {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	return e.sendCount > e.lastProbeSent
+}
+
+func (s *session) newCongestionControl(typ endpointType) CongestionControl {
+	if s.config.DisableCongestionControl || typ == endpointTCP {
+		// TCP has its own
+		return nil
+	}
+	return s.config.CongestionControl()
+}
+
+// NewCubicCongestionControl returns a CUBIC congestion control after
+// RFC 8312, whose window in frames of basePathMTU is paced over the
+// smoothed RTT. Loss below cubicLossTolerance is taken as random rather
+// than congestion, and the window does not grow while the path is not
+// fully used by the application.
+func NewCubicCongestionControl() CongestionControl {
+	return &cubic{
+		window:   cubicInitWindow,
+		ssthresh: math.Inf(1),
+		srtt:     cubicInitRTT,
+	}
+}
+
+type cubic struct {
+	window     float64
+	ssthresh   float64
+	wMax       float64
+	k          float64
+	epochStart time.Time
+	srtt       time.Duration
+	feedbackAt time.Time
+}
+
+func (c *cubic) OnFeedback(sent, delivered int, rtt time.Duration) {
+	now := time.Now()
+	elapsed := now.Sub(c.feedbackAt)
+	c.feedbackAt = now
+	if rtt > 0 {
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	if sent <= 0 {
+		return
+	}
+	if lost := sent - delivered; float64(lost) > cubicLossTolerance*float64(sent) {
+		// multiplicative decrease
+		c.wMax = c.window
+		c.window = math.Max(c.window*cubicBeta, cubicMinWindow)
+		c.ssthresh = c.window
+		c.epochStart = now
+		c.k = math.Cbrt(c.wMax * (1 - cubicBeta) / cubicC)
+		return
+	}
+	// frames delivered per RTT, the window only grows while it is used
+	if elapsed > 0 && float64(delivered)*float64(c.srtt)/float64(elapsed) < c.window/2 {
+		return
+	}
+	if c.window < c.ssthresh {
+		// slow start
+		c.window = math.Min(c.window+float64(delivered), 2*c.window)
+	} else {
+		if c.epochStart.IsZero() {
+			c.epochStart = now
+			c.wMax = c.window
+		}
+		t := now.Sub(c.epochStart).Seconds()
+		target := cubicC*math.Pow(t-c.k, 3) + c.wMax
+		c.window = math.Min(math.Max(target, c.window), 1.5*c.window)
+	}
+	c.window = math.Min(c.window, cubicMaxWindow)
+}
+
+func (c *cubic) PacingRate() float64 {
+	rate := cubicPacingGain * c.window * cubicSegment / c.srtt.Seconds()
+	return math.Max(rate, minPacingRate)
+}
+
+// pacer is a token bucket in bytes.
+type pacer struct {
+	tokens   float64
+	refillAt time.Time
+}
+
+// wait takes n bytes from the bucket refilled at rate, and returns how long
+// to wait before sending them.
+func (p *pacer) wait(n int, rate float64) time.Duration {
+	now := time.Now()
+	burst := math.Max(rate*pacerBurst.Seconds(), 4*maxPathMTU4)
+	if p.refillAt.IsZero() {
+		p.tokens = burst
+	} else {
+		p.tokens = math.Min(p.tokens+rate*now.Sub(p.refillAt).Seconds(), burst)
+	}
+	p.refillAt = now
+	p.tokens -= float64(n)
+	if p.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-p.tokens / rate * float64(time.Second))
+}
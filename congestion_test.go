@@ -0,0 +1,144 @@
+package mdp
+
+import (
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCubic(tt *testing.T) {
+	t := require.New(tt)
+	c := NewCubicCongestionControl().(*cubic)
+	initRate := c.PacingRate()
+	feedback := func(sent, delivered int) {
+		// a report per RTT
+		c.feedbackAt = time.Now().Add(-c.srtt)
+		c.OnFeedback(sent, delivered, c.srtt)
+	}
+
+	// slow start while the window is used
+	feedback(cubicInitWindow, cubicInitWindow)
+	t.Equal(float64(2*cubicInitWindow), c.window)
+	t.Greater(c.PacingRate(), initRate)
+
+	// no growth while application limited
+	feedback(10, 10)
+	t.Equal(float64(2*cubicInitWindow), c.window)
+
+	// random loss is tolerated
+	feedback(100, 99)
+	t.Equal(float64(4*cubicInitWindow), c.window)
+
+	// multiplicative decrease
+	window := c.window
+	feedback(100, 90)
+	t.Equal(window*cubicBeta, c.window)
+	t.Equal(window, c.wMax)
+	t.Equal(c.window, c.ssthresh)
+
+	// cubic growth back towards wMax
+	window = c.window
+	c.epochStart = time.Now().Add(-time.Duration(c.k * float64(time.Second)))
+	feedback(int(window), int(window))
+	t.InDelta(c.wMax, c.window, 1)
+
+	for i := 0; i < 100; i++ {
+		feedback(100, 0)
+	}
+	t.Equal(float64(cubicMinWindow), c.window)
+	t.Equal(float64(minPacingRate), c.PacingRate())
+}
+
+func TestPacer(tt *testing.T) {
+	t := require.New(tt)
+	var p pacer
+	const rate = 1 << 20
+	burst := 4 * maxPathMTU4
+	t.Zero(p.wait(burst, rate))
+	d := p.wait(rate/10, rate)
+	t.InDelta(float64(100*time.Millisecond), float64(d), float64(5*time.Millisecond))
+}
+
+type feedbackRecorder struct {
+	reports [][2]int
+}
+
+func (r *feedbackRecorder) OnFeedback(sent, delivered int, rtt time.Duration) {
+	r.reports = append(r.reports, [2]int{sent, delivered})
+}
+
+func (r *feedbackRecorder) PacingRate() float64 {
+	return math.Inf(1)
+}
+
+func TestResetFeedback(tt *testing.T) {
+	t := require.New(tt)
+	r := &feedbackRecorder{}
+	e := &endpoint{cc: r}
+	e.feedback(100, 100, time.Millisecond)
+	e.feedback(200, 190, time.Millisecond)
+	t.Equal([][2]int{{100, 90}}, r.reports)
+
+	// the peer counts from zero on a redialled conn
+	e.resetFeedback()
+	e.feedback(300, 5, time.Millisecond)
+	e.feedback(400, 100, time.Millisecond)
+	t.Equal([][2]int{{100, 90}, {100, 95}}, r.reports)
+}
+
+func TestCongestionFeedback(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+	go echo(server)
+
+	client, err := NewClient(Config{
+		IP4:          net.IPv4(127, 0, 0, 1),
+		Port:         port,
+		DisableICMDP: true,
+		DisableTCP:   true,
+	})
+	t.NoError(err)
+	defer client.Close()
+	go func() {
+		buf := make([]byte, 2000)
+		for {
+			if _, err := client.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	data := make([]byte, 1000)
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		_, err = client.Write(data)
+		t.NoError(err)
+		time.Sleep(time.Millisecond)
+	}
+
+	received := func(eps *sync.Map) bool {
+		ok := false
+		eps.Range(func(_, v interface{}) bool {
+			ep := v.(*endpoint)
+			ep.statM.Lock()
+			defer ep.statM.Unlock()
+			ok = ep.cc != nil && ep.feedbackValid && ep.cc.(*cubic).srtt != cubicInitRTT
+			return true
+		})
+		return ok
+	}
+	t.True(received(&client.sess.dstEndpoints), "client")
+	server.rangeSessions(func(sess *session) {
+		t.True(received(&sess.srcEndpoints), "server")
+	})
+}
@@ -1,6 +1,8 @@
 package mdp
 
 import (
+	"encoding/binary"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -8,8 +10,12 @@ import (
 	"github.com/poohvpn/pooh"
 )
 
-func dialTcpDatagram(addr *net.TCPAddr, id uint32, ob Obfuscator) (conn *tcpDatagram, err error) {
-	tcpConn, err := net.DialTCP("tcp", nil, addr)
+func dialTcpDatagram(laddr, addr *net.TCPAddr, control controlFunc, sid, nid uint32, ob Obfuscator) (conn *tcpDatagram, err error) {
+	dialer := &net.Dialer{Timeout: dialTimeout, Control: control}
+	if laddr != nil {
+		dialer.LocalAddr = laddr
+	}
+	tcpConn, err := dialer.Dial("tcp", addr.String())
 	if err != nil {
 		return
 	}
@@ -21,7 +27,11 @@ func dialTcpDatagram(addr *net.TCPAddr, id uint32, ob Obfuscator) (conn *tcpData
 			_ = conn.Close()
 		}
 	}()
-	err = conn.Conn.WriteUint32(id)
+	err = conn.Conn.WriteUint32(sid)
+	if err != nil {
+		return
+	}
+	err = conn.Conn.WriteUint32(nid)
 	if err != nil {
 		return
 	}
@@ -33,27 +43,40 @@ var _ net.Conn = &tcpDatagram{}
 type tcpDatagram struct {
 	pooh.Conn
 	writeM sync.Mutex
+	// length of the datagram being read
+	length [2]byte
 }
 
-// todo reconnect
-
 func (td *tcpDatagram) Read(b []byte) (n int, err error) {
-	length, err := td.Uint16()
+	_, err = io.ReadFull(td.Conn, td.length[:])
 	if err != nil {
 		return
 	}
-	data, err := td.Bytes(int(length))
-	if err != nil {
-		return
+	length := int(binary.BigEndian.Uint16(td.length[:]))
+	if length > len(b) {
+		// truncated like a datagram socket
+		_, err = io.ReadFull(td.Conn, b)
+		if err != nil {
+			return
+		}
+		_, err = io.CopyN(io.Discard, td.Conn, int64(length-len(b)))
+		return len(b), err
 	}
-	n = copy(b, data)
-	return
+	return io.ReadFull(td.Conn, b[:length])
 }
 
 func (td *tcpDatagram) Write(b []byte) (n int, err error) {
+	if len(b) > 0xffff {
+		// beyond the length prefix
+		return 0, errDatagramTooLarge
+	}
+	buf := getBuffer(2 + len(b))
+	defer putBuffer(buf)
+	binary.BigEndian.PutUint16(*buf, uint16(len(b)))
+	copy((*buf)[2:], b)
 	td.writeM.Lock()
 	defer td.writeM.Unlock()
-	_, err = td.Conn.Write(append(pooh.Int2Bytes(len(b), 2), b...))
+	_, err = td.Conn.Write(*buf)
 	n = len(b)
 	return
 }
@@ -77,6 +100,20 @@ func (p *writeOnlyConn) Write(b []byte) (n int, err error) {
 	return p.packetConn.WriteTo(b, p.remote)
 }
 
+func (p *writeOnlyConn) writeNow(b []byte) (n int, err error) {
+	if bc, ok := p.packetConn.(*batchConn); ok {
+		return bc.writeNowTo(b, p.remote)
+	}
+	return p.Write(b)
+}
+
+func (p *writeOnlyConn) writeTimeout(b []byte, timeout <-chan struct{}) (n int, err error) {
+	if bc, ok := p.packetConn.(*batchConn); ok {
+		return bc.writeToTimeout(b, p.remote, timeout)
+	}
+	return p.Write(b)
+}
+
 func (p *writeOnlyConn) Close() error {
 	return nil
 }
@@ -0,0 +1,49 @@
+package mdp
+
+import "syscall"
+
+// controlFunc is the Control of net.Dialer and net.ListenConfig, called on a
+// socket before it is bound or connected.
+type controlFunc = func(network, address string, c syscall.RawConn) error
+
+// socketControl returns the controlFunc setting fwMark and bindToDevice
+// before calling control, nil if there is nothing to do.
+func socketControl(control controlFunc, fwMark int, device string) controlFunc {
+	var controls []controlFunc
+	if fwMark != 0 {
+		controls = append(controls, func(network, address string, c syscall.RawConn) error {
+			return setMark(c, fwMark)
+		})
+	}
+	if device != "" {
+		controls = append(controls, func(network, address string, c syscall.RawConn) error {
+			return bindToDevice(c, device)
+		})
+	}
+	return chainControl(append(controls, control)...)
+}
+
+// chainControl returns the controlFunc calling the non nil controls in order
+// until one fails, nil if there is none.
+func chainControl(controls ...controlFunc) controlFunc {
+	var fs []controlFunc
+	for _, f := range controls {
+		if f != nil {
+			fs = append(fs, f)
+		}
+	}
+	switch len(fs) {
+	case 0:
+		return nil
+	case 1:
+		return fs[0]
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, f := range fs {
+			if err := f(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
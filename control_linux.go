@@ -0,0 +1,32 @@
+package mdp
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindsToDevice binds the sockets dialing from an interface to it.
+const bindsToDevice = true
+
+// setMark sets SO_MARK, which needs CAP_NET_ADMIN.
+func setMark(c syscall.RawConn, mark int) error {
+	var err error
+	if e := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+	}); e != nil {
+		return e
+	}
+	return err
+}
+
+// bindToDevice sets SO_BINDTODEVICE, which needs CAP_NET_RAW before Linux 5.7.
+func bindToDevice(c syscall.RawConn, device string) error {
+	var err error
+	if e := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, device)
+	}); e != nil {
+		return e
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package mdp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSocketControlLinux(tt *testing.T) {
+	t := require.New(tt)
+	dialer := &net.Dialer{Control: socketControl(nil, 0x1234, "lo")}
+	conn, err := dialer.Dial("udp", "127.0.0.1:9")
+	if err != nil {
+		// without CAP_NET_ADMIN
+		tt.Skip(err)
+	}
+	defer conn.Close()
+	raw, err := conn.(*net.UDPConn).SyscallConn()
+	t.NoError(err)
+	t.NoError(raw.Control(func(fd uintptr) {
+		mark, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+		t.NoError(err)
+		t.Equal(0x1234, mark)
+		device, err := unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+		t.NoError(err)
+		t.Equal("lo", device)
+	}))
+}
+
+func TestEndpointBindsToDevice(tt *testing.T) {
+	t := require.New(tt)
+	client, err := NewClient(Config{
+		IP4:          net.IPv4(127, 0, 0, 1),
+		Port:         freePort(t),
+		DisableTCP:   true,
+		DisableICMDP: true,
+		LocalAddrs:   []string{"127.0.0.1", "lo"},
+	})
+	t.NoError(err)
+	defer client.Close()
+	paths := client.Paths()
+	if len(paths) < 2 {
+		// without CAP_NET_RAW before Linux 5.7
+		tt.Skip("the endpoint bound to lo is not dialed")
+	}
+
+	var device string
+	client.sess.dstEndpoints.Range(func(_, v interface{}) bool {
+		ep := v.(*endpoint)
+		if ep.local != "lo" {
+			return true
+		}
+		raw, err := ep.getConn().(*batchConn).SyscallConn()
+		t.NoError(err)
+		t.NoError(raw.Control(func(fd uintptr) {
+			device, err = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+			t.NoError(err)
+		}))
+		return false
+	})
+	t.Equal("lo", device)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package mdp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindsToDevice is false, the sockets dialing from an interface are only
+// bound to its address.
+const bindsToDevice = false
+
+func setMark(c syscall.RawConn, mark int) error {
+	return errors.New("mdp: SO_MARK is not supported")
+}
+
+func bindToDevice(c syscall.RawConn, device string) error {
+	return errors.New("mdp: SO_BINDTODEVICE is not supported")
+}
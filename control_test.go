@@ -0,0 +1,80 @@
+package mdp
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainControl(tt *testing.T) {
+	t := require.New(tt)
+	t.Nil(chainControl(nil, nil))
+	t.Nil(socketControl(nil, 0, ""))
+
+	var calls []int
+	call := func(i int, err error) controlFunc {
+		return func(network, address string, c syscall.RawConn) error {
+			calls = append(calls, i)
+			return err
+		}
+	}
+	t.NoError(chainControl(call(1, nil), nil, call(2, nil))("udp", "", nil))
+	t.Equal([]int{1, 2}, calls)
+	calls = nil
+	errFailed := errors.New("failed")
+	t.Equal(errFailed, chainControl(call(1, errFailed), call(2, nil))("udp", "", nil))
+	t.Equal([]int{1}, calls)
+}
+
+func TestControl(tt *testing.T) {
+	t := require.New(tt)
+	var calls int32
+	control := func(network, address string, c syscall.RawConn) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:    port,
+		Control: control,
+	})
+	t.NoError(err)
+	defer server.Close()
+	t.True(server.config.DisableICMDP)
+	go echo(server)
+	// the TCP listener and UDP socket
+	t.EqualValues(2, atomic.LoadInt32(&calls))
+
+	client, err := NewClient(Config{
+		IP4:     net.IPv4(127, 0, 0, 1),
+		Port:    port,
+		Control: control,
+	})
+	t.NoError(err)
+	defer client.Close()
+	t.True(client.sess.config.DisableICMDP)
+	waitPaths(t, client, 2)
+	t.EqualValues(4, atomic.LoadInt32(&calls))
+	_, err = client.Write([]byte("hello"))
+	t.NoError(err)
+	t.NoError(client.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = client.Read(make([]byte, 10))
+	t.NoError(err)
+
+	// a failing control fails the dial
+	client, err = NewClient(Config{
+		IP4:  net.IPv4(127, 0, 0, 1),
+		Port: port,
+		Control: func(network, address string, c syscall.RawConn) error {
+			return errors.New("denied")
+		},
+	})
+	t.NoError(err)
+	defer client.Close()
+	t.Empty(client.Paths())
+}
@@ -0,0 +1,86 @@
+package mdp
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ net.Error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mdp: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Is makes timeoutError match os.ErrDeadlineExceeded like the errors of net.
+func (timeoutError) Is(err error) bool { return err == os.ErrDeadlineExceeded }
+
+// deadline is a resettable deadline whose wait channel is closed once the
+// deadline is exceeded, in the manner of net.Pipe.
+type deadline struct {
+	m      sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{
+		cancel: make(chan struct{}),
+	}
+}
+
+// set resets the deadline, the zero time means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() {
+			close(d.cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel which is closed when the deadline is exceeded.
+func (d *deadline) wait() chan struct{} {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.cancel
+}
+
+func (d *deadline) exceeded() bool {
+	return isClosedChan(d.wait())
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
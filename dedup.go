@@ -0,0 +1,65 @@
+package mdp
+
+import "sync"
+
+const (
+	dedupWindowSize = 1024
+	// dedupRestartDistance is how far behind a sequence has to be to come
+	// from a restarted peer rather than a slow path
+	dedupRestartDistance = 1 << 20
+)
+
+// dedupWindow suppresses duplicated sequences of redundant mode within a
+// sliding window, in the manner of the IPsec anti-replay window. Sequences
+// older than the window are taken as late copies on a slow path and dropped.
+// Every run of a peer counts from a random sequence, so one further behind
+// than dedupRestartDistance means that the peer restarted with the same
+// session ID, which restarts the window. A restart landing closer behind, 1
+// in 4096, is dropped until it catches up.
+type dedupWindow struct {
+	m       sync.Mutex
+	started bool
+	highest uint32
+	bitmap  [dedupWindowSize / 64]uint64
+}
+
+// accept reports whether seq is seen for the first time.
+func (w *dedupWindow) accept(seq uint32) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+	diff := int32(seq - w.highest)
+	switch {
+	case !w.started || diff <= -dedupRestartDistance:
+		w.started = true
+		w.bitmap = [dedupWindowSize / 64]uint64{}
+		w.highest = seq
+	case diff > 0:
+		if diff >= dedupWindowSize {
+			w.bitmap = [dedupWindowSize / 64]uint64{}
+		} else {
+			for i := uint32(1); i <= uint32(diff); i++ {
+				w.clear(w.highest + i)
+			}
+		}
+		w.highest = seq
+	case diff <= -dedupWindowSize || w.test(seq):
+		return false
+	}
+	w.set(seq)
+	return true
+}
+
+func (w *dedupWindow) test(seq uint32) bool {
+	i := seq % dedupWindowSize
+	return w.bitmap[i/64]&(1<<(i%64)) != 0
+}
+
+func (w *dedupWindow) set(seq uint32) {
+	i := seq % dedupWindowSize
+	w.bitmap[i/64] |= 1 << (i % 64)
+}
+
+func (w *dedupWindow) clear(seq uint32) {
+	i := seq % dedupWindowSize
+	w.bitmap[i/64] &^= 1 << (i % 64)
+}
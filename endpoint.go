@@ -1,8 +1,12 @@
 package mdp
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/poohvpn/icmdp"
@@ -18,159 +22,530 @@ const (
 	endpointICMDP endpointType = 0x1
 )
 
-// auto-reconnect
+// endpoint is a single transport path of a session,
+// dst endpoints redial automatically when their conn is broken.
 type endpoint struct {
-	index     uint64
-	typ       endpointType
-	dst       bool
-	addr      *Addr
-	conn      net.Conn
-	lastRecv  time.Time
-	lastSent  time.Time
-	recvCount int
-	sendCount int
-}
-
-func (e *endpoint) send(data []byte) (err error) {
+	index      endpointKey
+	typ        endpointType
+	dst        bool
+	addr       *Addr
+	local      string // local IP or interface name to dial from, see Config.LocalAddrs
+	conn       net.Conn
+	connM      sync.RWMutex
+	retired    bool // guarded by connM, see retire
+	statM      sync.Mutex
+	lastRecv   time.Time
+	lastSent   time.Time
+	recvCount  int
+	sendCount  int
+	rateAt     time.Time
+	rateBytes  int
+	throughput float64
+	probeID    uint32
+	probes     map[uint32]sentProbe // probe ID -> sent probe
+	lastProbe  time.Time
+	srtt       time.Duration
+	rttVar     time.Duration
+	lastRTT    time.Duration
+	jitter     time.Duration
+	loss       float64
+	// health, see available
+	broken      bool
+	retiring    bool // hopped away from, by this side or the peer, see hop
+	retireAck   chan struct{}
+	writeErrors int
+	probeLosses int
+	// path MTU discovery, see pmtu.go
+	mtu         int
+	pmtuHigh    int // the smallest size known not to fit
+	pmtuProbe   int // the size of the path probe in flight
+	pmtuProbeID uint32
+	pmtuSentAt  time.Time
+	pmtuLosses  int
+	pmtuDoneAt  time.Time
+	// congestion control, see congestion.go
+	cc            CongestionControl
+	pacer         pacer
+	lastProbeSent int
+	feedbackValid bool
+	feedbackSent  int
+	feedbackRecv  int
+}
+
+var _ Path = &endpoint{}
+
+func (t endpointType) String() string {
+	switch t {
+	case endpointTCP:
+		return "tcp"
+	case endpointUDP:
+		return "udp"
+	case endpointICMDP:
+		return "icmdp"
+	default:
+		return "unknown"
+	}
+}
+
+func (e *endpoint) getConn() net.Conn {
+	e.connM.RLock()
+	defer e.connM.RUnlock()
+	return e.conn
+}
+
+func (e *endpoint) setConn(conn net.Conn) {
+	e.connM.Lock()
+	defer e.connM.Unlock()
+	if e.retired && conn != nil {
+		_ = conn.Close()
+		return
+	}
+	e.conn = conn
+}
+
+func (e *endpoint) isRetired() bool {
+	e.connM.RLock()
+	defer e.connM.RUnlock()
+	return e.retired
+}
+
+// retire removes the endpoint from its session and closes it for good,
+// which ends the forwardLoop of a dst endpoint instead of redialing.
+func (e *endpoint) retire() {
+	e.drop()
+	e.connM.Lock()
+	e.retired = true
+	conn := e.conn
+	e.conn = nil
+	e.connM.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+// nowWriter is a conn queueing its writes, such as batchConn, which writes
+// at once by writeNow.
+type nowWriter interface {
+	writeNow(b []byte) (int, error)
+}
+
+// timeoutWriter is a conn whose writes wait while its queue is full, such
+// as batchConn, which fails them once timeout is closed by writeTimeout.
+type timeoutWriter interface {
+	writeTimeout(b []byte, timeout <-chan struct{}) (int, error)
+}
+
+// send sends data, failing once timeout is closed while queueing it.
+func (e *endpoint) send(data []byte, timeout <-chan struct{}) error {
+	return e.write(data, false, timeout)
+}
+
+// write sends data, at once rather than queued if now, so that the error is
+// of data itself, or fails once timeout is closed while queueing it.
+func (e *endpoint) write(data []byte, now bool, timeout <-chan struct{}) (err error) {
+	conn := e.getConn()
+	if conn == nil {
+		return errors.New("mdp: endpoint is not connected")
+	}
 	if debug {
 		log.Debug().
-			Str("local", e.conn.LocalAddr().String()).
-			Str("remote", e.conn.RemoteAddr().String()).
+			Str("local", conn.LocalAddr().String()).
+			Str("remote", conn.RemoteAddr().String()).
 			Bytes("data", data).
 			Msg("endpoint.output")
 	}
-	defer func() {
-		if err != nil {
+	defer e.updateHealth(func() {
+		if err == nil {
 			e.sendCount++
+			e.lastSent = time.Now()
+			e.writeErrors = 0
+		} else if _, ok := err.(timeoutError); !ok {
+			e.writeErrors++
 		}
-	}()
-	_, err = e.conn.Write(data)
+	})
+	if w, ok := conn.(nowWriter); ok && now {
+		_, err = w.writeNow(data)
+	} else if w, ok := conn.(timeoutWriter); ok && timeout != nil {
+		_, err = w.writeTimeout(data, timeout)
+	} else {
+		_, err = conn.Write(data)
+	}
+	if e.dst && err == nil {
+		atomic.AddUint64(&e.addr.sess.dstBytes, uint64(len(data)))
+	}
 	return
 }
 
-func (e *endpoint) recv(data []byte) bool {
-	e.lastRecv = time.Now()
-	e.recvCount++
-	return e.addr.sess.input(data, e.dst)
+func (e *endpoint) recv(p []byte) bool {
+	h, payload, err := parseFrame(p)
+	if err != nil {
+		if debug {
+			log.Debug().Err(err).Msg("mdp: endpoint.recv")
+		}
+		return true
+	}
+	e.statRecv(len(p))
+	if e.dst {
+		atomic.AddUint64(&e.addr.sess.dstBytes, uint64(len(p)))
+	}
+	if h.typ != frameData {
+		e.addr.sess.control(e, &h, payload)
+		return true
+	}
+	if h.flags&flagFEC != 0 && !e.addr.sess.fecInput(h.seq, payload, e.dst) {
+		return false
+	}
+	return e.addr.sess.input(payload, h.seq, e.dst)
+}
+
+// sendFrame sends a control frame of the session, probes and their echoes
+// at once, and the rest such as frameClose behind the queued data, which it
+// must not overtake.
+func (e *endpoint) sendFrame(typ frameType, flags byte, payload []byte) error {
+	config := &e.addr.sess.config
+	h := header{
+		typ:   typ,
+		flags: flags,
+		sid:   config.SessionID,
+		nid:   config.NodeID,
+	}
+	now := typ == framePing || typ == framePong || typ == framePathProbe
+	return e.write(h.marshal(payload), now, nil)
+}
+
+// statRecv updates receive statistics, throughput is averaged over windows of
+// at least throughputWindow.
+func (e *endpoint) statRecv(n int) {
+	e.updateHealth(func() {
+		now := time.Now()
+		e.lastRecv = now
+		e.recvCount++
+		if e.rateAt.IsZero() {
+			e.rateAt = now
+		}
+		e.rateBytes += n
+		if elapsed := now.Sub(e.rateAt); elapsed >= throughputWindow {
+			e.throughput = (e.throughput + float64(e.rateBytes)/elapsed.Seconds()) / 2
+			e.rateAt = now
+			e.rateBytes = 0
+		}
+		// anything received proves the path
+		e.broken = false
+		e.writeErrors = 0
+		e.probeLosses = 0
+	})
+}
+
+func (e *endpoint) Network() string {
+	return e.typ.String()
+}
+
+func (e *endpoint) LocalAddr() net.Addr {
+	if conn := e.getConn(); conn != nil {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+func (e *endpoint) RemoteAddr() net.Addr {
+	if conn := e.getConn(); conn != nil {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (e *endpoint) LastRecv() time.Time {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	return e.lastRecv
+}
+
+func (e *endpoint) LastSent() time.Time {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	return e.lastSent
+}
+
+func (e *endpoint) Throughput() float64 {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	if time.Since(e.lastRecv) > 2*throughputWindow {
+		// nothing received in the last windows
+		return 0
+	}
+	return e.throughput
 }
 
 func (e *endpoint) run() {
 	if e.dst {
 		e.forwardLoop()
+		e.drop()
 	} else {
 		e.inputLoop()
 	}
-	e.drop()
 }
 
 func (e *endpoint) inputLoop() {
-	switch conn := e.conn.(type) {
+	switch conn := e.getConn().(type) {
 	case *writeOnlyConn:
 		// does not need to handle server side PacketConn, which is already received by PacketConn loop
 		return
 	default:
-		defer e.conn.Close()
-		buf := make([]byte, pooh.BufferSize)
-		for {
-			n, err := conn.Read(buf)
-			if err != nil {
-				if debug && err != io.EOF {
-					log.Debug().Err(err).Msg("mdp: endpoint.conn is broken")
-				}
-				return
-			}
-			if !e.recv(pooh.Duplicate(buf[:n])) {
-				return
+		// the peer dials a new conn instead of a broken one, which takes over the session
+		defer e.drop()
+		defer conn.Close()
+		e.readLoop(conn)
+		e.updateHealth(func() {
+			e.broken = true
+		})
+	}
+}
+
+// readLoop feeds packets from conn to the session until conn is broken,
+// and reports whether any packet was received.
+func (e *endpoint) readLoop(conn net.Conn) (received bool) {
+	if bc, ok := conn.(*batchConn); ok {
+		err := bc.readPackets(func(p []byte, _ net.Addr) bool {
+			received = true
+			return e.recv(p)
+		})
+		if debug && err != nil {
+			log.Debug().Err(err).Msg("mdp: endpoint.conn is broken")
+		}
+		return
+	}
+	buf := make([]byte, pooh.BufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if debug && err != io.EOF {
+				log.Debug().Err(err).Msg("mdp: endpoint.conn is broken")
 			}
+			return
+		}
+		received = true
+		if !e.recv(buf[:n]) {
+			return
 		}
 	}
 }
 
 func (e *endpoint) forwardLoop() {
+	sess := e.addr.sess
+	attempt := 0
 	for {
+		if e.isRetired() {
+			return
+		}
+		conn := e.getConn()
+		if conn == nil {
+			err := e.dial()
+			if err == nil {
+				conn = e.getConn()
+			} else if debug {
+				log.Debug().Err(err).Str("remote", e.addr.String()).Int("attempt", attempt).Msg("mdp: endpoint.dial")
+			}
+		}
+		if conn != nil {
+			if sess.closeOnce.Done() {
+				_ = conn.Close()
+				return
+			}
+			if e.readLoop(conn) {
+				attempt = 0
+			}
+			e.updateHealth(func() {
+				e.broken = true
+			})
+			e.setConn(nil)
+			e.resetMTU()
+			e.resetFeedback()
+			_ = conn.Close()
+		}
+		if sess.closeOnce.Done() || e.isRetired() {
+			return
+		}
+		select {
+		case <-sess.closeOnce.Wait():
+			return
+		case <-time.After(backoff(attempt)):
+		}
+		attempt++
+	}
+}
 
+// localIP returns the IP to dial from of the family of the remote, nil for
+// the default route.
+func (e *endpoint) localIP() (ip net.IP, zone string, err error) {
+	if e.local == "" {
+		return
+	}
+	if ip = net.ParseIP(e.local); ip != nil {
+		return
+	}
+	ifi, err := net.InterfaceByName(e.local)
+	if err != nil {
+		return
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return
 	}
+	ipv4 := pooh.IsIPv4(e.addr.IP)
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || pooh.IsIPv4(ipNet.IP) != ipv4 {
+			continue
+		}
+		// prefer a routable address to a link local one
+		if ip == nil || ip.IsLinkLocalUnicast() {
+			ip = ipNet.IP
+		}
+	}
+	if ip == nil {
+		return nil, "", fmt.Errorf("mdp: no address of %s on interface %s", e.addr.IP, e.local)
+	}
+	if ip.IsLinkLocalUnicast() {
+		zone = e.local
+	}
+	return
 }
 
-func (e *endpoint) dial() {
-	var (
-		conn net.Conn
-		err  error
-	)
+// control returns the Control of the TCP and UDP sockets of the endpoint,
+// which are bound to the interface they dial from, as its address alone does
+// not keep them from being routed out of another.
+func (e *endpoint) control() controlFunc {
+	config := e.addr.sess.config
+	device := config.BindToDevice
+	if bindsToDevice && e.local != "" && net.ParseIP(e.local) == nil {
+		device = e.local
+	}
+	return socketControl(config.Control, config.FwMark, device)
+}
+
+func (e *endpoint) dial() (err error) {
+	config := e.addr.sess.config
+	localIP, localZone, err := e.localIP()
+	if err != nil {
+		return
+	}
+	var conn net.Conn
 	switch e.typ {
 	case endpointTCP:
-		conn, err = dialTcpDatagram(
+		var tcpConn *tcpDatagram
+		var laddr *net.TCPAddr
+		if localIP != nil {
+			laddr = &net.TCPAddr{IP: localIP, Zone: localZone}
+		}
+		tcpConn, err = dialTcpDatagram(
+			laddr,
 			&net.TCPAddr{
 				IP:   e.addr.IP,
 				Port: e.addr.Port,
 				Zone: e.addr.Zone,
 			},
-			e.addr.sess.config.SessionID,
-			e.addr.sess.config.Obfuscator,
+			e.control(),
+			config.SessionID,
+			config.NodeID,
+			config.Obfuscator,
 		)
+		if err != nil {
+			return
+		}
+		conn = tcpConn
 	case endpointUDP:
-		conn, err = net.DialUDP("udp", nil, &net.UDPAddr{
+		dialer := &net.Dialer{Control: chainControl(dontFragment, e.control())}
+		if localIP != nil {
+			dialer.LocalAddr = &net.UDPAddr{IP: localIP, Zone: localZone}
+		}
+		var c net.Conn
+		c, err = dialer.Dial("udp", (&net.UDPAddr{
 			IP:   e.addr.IP,
 			Port: e.addr.Port,
 			Zone: e.addr.Zone,
-		})
-	case endpointICMDP:
-		if pooh.IsIPv4(e.addr.IP) {
-			conn, err = icmdp.DialICMDP("udp4", nil, &icmdp.Addr{
-				IP: e.addr.IP,
-			})
-			if err != nil {
-				conn, err = icmdp.DialICMDP("icmdp4", nil, &icmdp.Addr{
-					IP: e.addr.IP,
-				})
-			}
+		}).String())
+		if err != nil {
+			return
+		}
+		udpConn := c.(*net.UDPConn)
+		if batchable(config.Obfuscator) {
+			conn = newBatchConn(udpConn, udpConn.RemoteAddr())
 		} else {
-			conn, err = icmdp.DialICMDP("udp6", nil, &icmdp.Addr{
-				IP:   e.addr.IP,
-				Zone: e.addr.Zone,
-			})
-			if err != nil {
-				conn, err = icmdp.DialICMDP("icmdp6", nil, &icmdp.Addr{
-					IP:   e.addr.IP,
-					Zone: e.addr.Zone,
-				})
-			}
+			conn = config.Obfuscator.ObfuscateDatagramConn(udpConn)
 		}
+	case endpointICMDP:
+		var icmdpConn *icmdp.Conn
+		network := "4"
+		if !pooh.IsIPv4(e.addr.IP) {
+			network = "6"
+		}
+		raddr := &icmdp.Addr{
+			IP:   e.addr.IP,
+			Zone: e.addr.Zone,
+		}
+		var laddr *icmdp.Addr
+		if localIP != nil {
+			laddr = &icmdp.Addr{IP: localIP, Zone: localZone}
+		}
+		icmdpConn, err = icmdp.DialICMDP("udp"+network, laddr, raddr)
+		if err != nil {
+			icmdpConn, err = icmdp.DialICMDP("icmdp"+network, laddr, raddr)
+		}
+		if err != nil {
+			return
+		}
+		conn = config.Obfuscator.ObfuscateDatagramConn(icmdpConn)
 	default:
 		panic(e.typ)
 	}
-	if err != nil {
-		return
-	}
-	switch network {
-	case "udp4", "udp6", "icmdp4", "icmdp6":
-		conn = ob.ObfuscateDatagramConn(conn)
-	}
-	if s.localAddr == nil {
-		s.setInputAddr(conn.LocalAddr())
-	}
-	if s.srcAddr == nil {
-		s.setInputAddr(remote)
-	}
-
-	// append new conn to srcEndpoints
-	ep := &endpoint{
-		super: s,
-		conn:  conn,
-	}
-	s.srcEndpoints.Store(connIndex(conn), ep)
-	go ep.run()
+	e.setConn(conn)
 	return
 }
 
+// drop removes the endpoint from its session.
 func (e *endpoint) drop() {
+	eps := &e.addr.sess.srcEndpoints
 	if e.dst {
-		e.addr.sess.srcEndpoints.Delete(e.index)
-	} else {
-		e.addr.sess.dstEndpoints.Delete(e.index)
+		eps = &e.addr.sess.dstEndpoints
+	}
+	if v, ok := eps.Load(e.index); ok && v == e {
+		eps.Delete(e.index)
 	}
 }
 
+// available reports whether the endpoint is healthy to output on. It is not
+// while retiring, after a read error, maxWriteErrors consecutive write errors or
+// maxProbeLosses consecutive lost probes, and is quarantined until anything
+// is received on it again, which the probeLoop keeps trying on dst endpoints.
 func (e *endpoint) available() bool {
-	panic("implement me")
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	return e.healthy()
+}
+
+func (e *endpoint) healthy() bool {
+	return !e.retiring && !e.broken && e.writeErrors < maxWriteErrors && e.probeLosses < maxProbeLosses
+}
+
+// updateHealth applies f to the statistics under statM and reports the
+// availability change to config.OnPathStateChange.
+func (e *endpoint) updateHealth(f func()) {
+	e.statM.Lock()
+	before := e.healthy()
+	f()
+	after := e.healthy()
+	e.statM.Unlock()
+	if before == after {
+		return
+	}
+	if debug {
+		log.Debug().Str("network", e.Network()).Str("addr", e.addr.String()).Bool("available", after).Msg("mdp: endpoint state")
+	}
+	if handler := e.addr.sess.config.OnPathStateChange; handler != nil {
+		handler(e, after)
+	}
+}
+
+func (e *endpoint) Available() bool {
+	return e.available()
 }
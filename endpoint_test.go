@@ -0,0 +1,43 @@
+package mdp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointAvailable(tt *testing.T) {
+	t := require.New(tt)
+	var states []bool
+	sess := newSession(Config{
+		OnPathStateChange: func(path Path, available bool) {
+			states = append(states, available)
+		},
+	})
+	conn, peer := net.Pipe()
+	t.NoError(peer.Close())
+	ep := &endpoint{
+		typ:  endpointUDP,
+		addr: &Addr{sess: sess},
+		conn: conn,
+	}
+	t.True(ep.available())
+	for i := 0; i < maxWriteErrors; i++ {
+		t.True(ep.available())
+		t.Error(ep.send([]byte("data"), nil))
+	}
+	t.False(ep.available())
+	t.Equal([]bool{false}, states)
+
+	// being quarantined until anything is received
+	ep.statRecv(10)
+	t.True(ep.available())
+	t.Equal([]bool{false, true}, states)
+
+	ep.updateHealth(func() {
+		ep.broken = true
+	})
+	t.False(ep.Available())
+	t.Equal([]bool{false, true, false}, states)
+}
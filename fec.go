@@ -0,0 +1,244 @@
+package mdp
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+// XOR forward error correction: every config.FECGroupSize frameData of a
+// side are followed by a frameParity with the payload
+// k[1] seq[4]*k parity...
+// where parity is the XOR of len[2] payload of the k datagrams padded to the
+// longest, so the peer recovers any single lost datagram of the group.
+const (
+	fecMaxGroupSize = 32
+	// fecCacheSize is the number of datagrams kept per side for recovery
+	fecCacheSize = 1024
+	// fecMaxPending is the number of parities kept waiting for their groups
+	fecMaxPending = 64
+)
+
+type fecEncoder struct {
+	m      sync.Mutex
+	seqs   []uint32
+	parity []byte
+}
+
+// add accumulates datagram seq, and returns the parity payload once the
+// group of k is complete.
+func (e *fecEncoder) add(seq uint32, data []byte, k int) []byte {
+	e.seqs = append(e.seqs, seq)
+	e.parity = xorDatagram(e.parity, data)
+	if len(e.seqs) < k {
+		return nil
+	}
+	p := make([]byte, 1+sequenceSize*k+len(e.parity))
+	p[0] = byte(k)
+	for i, seq := range e.seqs {
+		binary.BigEndian.PutUint32(p[1+sequenceSize*i:], seq)
+	}
+	copy(p[1+sequenceSize*k:], e.parity)
+	e.seqs = e.seqs[:0]
+	e.parity = e.parity[:0]
+	return p
+}
+
+// xorDatagram XORs len[2] data into parity, which grows as needed.
+func xorDatagram(parity, data []byte) []byte {
+	for len(parity) < 2+len(data) {
+		parity = append(parity, 0)
+	}
+	parity[0] ^= byte(len(data) >> 8)
+	parity[1] ^= byte(len(data))
+	for i, b := range data {
+		parity[2+i] ^= b
+	}
+	return parity
+}
+
+type fecGroup struct {
+	seqs   []uint32
+	parity []byte
+}
+
+type fecDatagram struct {
+	seq  uint32
+	data []byte
+}
+
+type fecDecoder struct {
+	m       sync.Mutex
+	cache   map[uint32][]byte
+	order   []uint32 // ring of the cached seqs
+	next    int
+	pending []*fecGroup
+}
+
+func (d *fecDecoder) store(seq uint32, data []byte) {
+	if d.cache == nil {
+		d.cache = make(map[uint32][]byte)
+		d.order = make([]uint32, fecCacheSize)
+	}
+	if _, ok := d.cache[seq]; ok {
+		return
+	}
+	if old := d.order[d.next]; old != 0 {
+		delete(d.cache, old)
+	}
+	d.order[d.next] = seq
+	d.next = (d.next + 1) % fecCacheSize
+	// data is borrowed from the read buffer
+	d.cache[seq] = append([]byte(nil), data...)
+}
+
+// data caches datagram seq and returns the datagrams recovered with it.
+func (d *fecDecoder) data(seq uint32, data []byte) (res []fecDatagram) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.store(seq, data)
+	pending := d.pending[:0]
+	for _, g := range d.pending {
+		if !g.has(seq) {
+			pending = append(pending, g)
+			continue
+		}
+		rec, done := d.recover(g)
+		if rec != nil {
+			res = append(res, *rec)
+		}
+		if !done {
+			pending = append(pending, g)
+		}
+	}
+	d.pending = pending
+	return
+}
+
+// parity handles a parity payload and returns the datagram recovered by it.
+func (d *fecDecoder) parity(p []byte) *fecDatagram {
+	if len(p) < 1 {
+		return nil
+	}
+	k := int(p[0])
+	if k < 2 || len(p) < 1+sequenceSize*k+2 {
+		return nil
+	}
+	g := &fecGroup{
+		seqs:   make([]uint32, k),
+		parity: append([]byte(nil), p[1+sequenceSize*k:]...),
+	}
+	for i := range g.seqs {
+		g.seqs[i] = binary.BigEndian.Uint32(p[1+sequenceSize*i:])
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	rec, done := d.recover(g)
+	if !done {
+		if len(d.pending) == fecMaxPending {
+			d.pending = d.pending[1:]
+		}
+		d.pending = append(d.pending, g)
+	}
+	return rec
+}
+
+// recover recovers the datagram missing from group g, done reports whether
+// nothing is missing from g anymore.
+func (d *fecDecoder) recover(g *fecGroup) (rec *fecDatagram, done bool) {
+	var missing []uint32
+	for _, seq := range g.seqs {
+		if _, ok := d.cache[seq]; !ok {
+			missing = append(missing, seq)
+		}
+	}
+	switch len(missing) {
+	case 0:
+		return nil, true
+	case 1:
+	default:
+		return nil, false
+	}
+	buf := append([]byte(nil), g.parity...)
+	for _, seq := range g.seqs {
+		if data, ok := d.cache[seq]; ok {
+			if 2+len(data) > len(buf) {
+				// corrupted
+				return nil, true
+			}
+			buf = xorDatagram(buf, data)
+		}
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if 2+n > len(buf) {
+		return nil, true
+	}
+	rec = &fecDatagram{
+		seq:  missing[0],
+		data: buf[2 : 2+n],
+	}
+	d.store(rec.seq, rec.data)
+	return rec, true
+}
+
+func (g *fecGroup) has(seq uint32) bool {
+	for _, s := range g.seqs {
+		if s == seq {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *session) fecEncoder(dst bool) *fecEncoder {
+	if dst {
+		return &s.dstFECEncoder
+	}
+	return &s.srcFECEncoder
+}
+
+func (s *session) fecDecoder(dst bool) *fecDecoder {
+	if dst {
+		return &s.dstFECDecoder
+	}
+	return &s.srcFECDecoder
+}
+
+// fecInput caches a protected datagram, and inputs the datagrams recovered
+// with it.
+func (s *session) fecInput(seq uint32, data []byte, dst bool) bool {
+	for _, rec := range s.fecDecoder(dst).data(seq, data) {
+		if !s.input(rec.data, rec.seq, dst) {
+			return false
+		}
+	}
+	return true
+}
+
+// fecParity inputs the datagram recovered by a parity.
+func (s *session) fecParity(p []byte, dst bool) {
+	if rec := s.fecDecoder(dst).parity(p); rec != nil {
+		s.input(rec.data, rec.seq, dst)
+	}
+}
+
+// outputParity sends a parity on the next of the scheduled endpoints in
+// turn, so a group and its parity are spread across endpoints.
+func (s *session) outputParity(p []byte, dst bool, timeout <-chan struct{}) {
+	eps := s.schedule(dst, fecMaxGroupSize, maxHeaderSize+len(p), nil)
+	if len(eps) == 0 {
+		return
+	}
+	ep := eps[atomic.AddUint64(&s.parityCount, 1)%uint64(len(eps))]
+	h := header{
+		typ: frameParity,
+		sid: s.config.SessionID,
+		nid: s.config.NodeID,
+	}
+	buf := getBuffer(h.size() + len(p))
+	defer putBuffer(buf)
+	packet := h.marshalTo(*buf, p)
+	if ep.pace(len(packet), timeout) == nil {
+		_ = ep.send(packet, timeout)
+	}
+}
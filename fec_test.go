@@ -0,0 +1,102 @@
+package mdp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFEC(tt *testing.T) {
+	t := require.New(tt)
+	const k = 4
+	var (
+		enc fecEncoder
+		dec fecDecoder
+	)
+	datagrams := [][]byte{
+		[]byte("a"),
+		[]byte("hello"),
+		{},
+		[]byte("world!"),
+	}
+	for lost := range datagrams {
+		var parity []byte
+		for i, data := range datagrams {
+			seq := uint32(lost*k + i + 1)
+			parity = enc.add(seq, data, k)
+			if i != lost {
+				t.Empty(dec.data(seq, data))
+			}
+		}
+		t.NotNil(parity)
+		rec := dec.parity(parity)
+		t.NotNil(rec, "lost %d", lost)
+		t.Equal(uint32(lost*k+lost+1), rec.seq)
+		t.Equal(datagrams[lost], rec.data)
+	}
+
+	// the parity arrives before the rest of its group
+	var parity []byte
+	for i, data := range datagrams {
+		parity = enc.add(uint32(100+i), data, k)
+	}
+	t.Nil(dec.parity(parity))
+	t.Empty(dec.data(100, datagrams[0]))
+	t.Empty(dec.data(102, datagrams[2]))
+	res := dec.data(103, datagrams[3])
+	t.Len(res, 1)
+	t.Equal(uint32(101), res[0].seq)
+	t.Equal(datagrams[1], res[0].data)
+	t.Empty(dec.pending)
+
+	// two losses of a group are not recoverable
+	for i, data := range datagrams {
+		parity = enc.add(uint32(200+i), data, k)
+	}
+	t.Empty(dec.data(200, datagrams[0]))
+	t.Empty(dec.data(201, datagrams[1]))
+	t.Nil(dec.parity(parity))
+}
+
+func TestClientFEC(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		IP4:          net.IPv4(127, 0, 0, 1),
+		Port:         port,
+		DisableICMDP: true,
+		DisableTCP:   true,
+		FECGroupSize: 4,
+		Obfuscator: testObfuscator{drop: dropFrames(func(h header) bool {
+			// one of each group
+			return h.typ == frameData && h.seq%4 == 2
+		})},
+	})
+	t.NoError(err)
+	defer client.Close()
+
+	const count = 100
+	for i := 0; i < count; i++ {
+		_, err = client.Write([]byte(fmt.Sprint(i)))
+		t.NoError(err)
+	}
+	received := make(map[string]bool)
+	buf := make([]byte, 100)
+	t.NoError(server.SetReadDeadline(time.Now().Add(time.Second)))
+	for len(received) < count {
+		n, _, err := server.ReadFrom(buf)
+		t.NoError(err, "received %d of %d", len(received), count)
+		t.False(received[string(buf[:n])], "duplicated")
+		received[string(buf[:n])] = true
+	}
+}
@@ -0,0 +1,179 @@
+package mdp
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Datagrams larger than config.FragmentSize are sent as frameFragment with
+// the payload
+// id[4] index[2] count[2] chunk...
+// where id is from the sequence of the session, so a reassembled datagram
+// is deduplicated by it like a sequenced frameData.
+const (
+	fragmentHeaderSize = 8
+	// maxFragmentSize keeps frames within the length prefix of tcpDatagram
+	maxFragmentSize = tcpPathMTU - maxHeaderSize
+	// minFragmentSize bounds the fragments of a datagram, all of which but
+	// the last carry at least minFragmentChunk
+	minFragmentSize     = 576
+	minFragmentChunk    = minFragmentSize - fragmentHeaderSize
+	defaultMaxWriteSize = 0xffff
+	// fragmentTimeout drops the datagrams not reassembled in time
+	fragmentTimeout = 3 * time.Second
+	// maxPartialDatagrams is the number of datagrams reassembled at once per side
+	maxPartialDatagrams = 64
+)
+
+var errDatagramTooLarge = errors.New("mdp: datagram is larger than MaxWriteSize")
+
+type partialDatagram struct {
+	chunks [][]byte
+	got    int
+	size   int
+	at     time.Time
+}
+
+type reassembler struct {
+	m        sync.Mutex
+	partials map[uint32]*partialDatagram
+	sweptAt  time.Time
+}
+
+// add adds the fragment index of count of datagram id, and returns the
+// datagram when it is complete. Datagrams larger than max are dropped, and so
+// is a count of more fragments than max takes before anything is allocated.
+func (r *reassembler) add(id uint32, index, count int, chunk []byte, max int) []byte {
+	if index >= count || count > maxFragments(max) {
+		return nil
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	now := time.Now()
+	r.sweep(now)
+	if r.partials == nil {
+		r.partials = make(map[uint32]*partialDatagram)
+	}
+	p, ok := r.partials[id]
+	if !ok {
+		if len(r.partials) >= maxPartialDatagrams {
+			r.evictOldest()
+		}
+		p = &partialDatagram{
+			chunks: make([][]byte, count),
+			at:     now,
+		}
+		r.partials[id] = p
+	}
+	if len(p.chunks) != count || p.chunks[index] != nil {
+		// inconsistent or duplicated
+		return nil
+	}
+	// chunk is borrowed from the read buffer
+	p.chunks[index] = append([]byte(nil), chunk...)
+	p.got++
+	p.size += len(chunk)
+	if p.size > max {
+		delete(r.partials, id)
+		return nil
+	}
+	if p.got < count {
+		return nil
+	}
+	delete(r.partials, id)
+	data := make([]byte, 0, p.size)
+	for _, c := range p.chunks {
+		data = append(data, c...)
+	}
+	return data
+}
+
+// maxFragments returns the most fragments of a datagram of max bytes.
+func maxFragments(max int) int {
+	return (max + minFragmentChunk - 1) / minFragmentChunk
+}
+
+func (r *reassembler) sweep(now time.Time) {
+	if now.Sub(r.sweptAt) < fragmentTimeout/2 {
+		return
+	}
+	r.sweptAt = now
+	for id, p := range r.partials {
+		if now.Sub(p.at) >= fragmentTimeout {
+			delete(r.partials, id)
+		}
+	}
+}
+
+func (r *reassembler) evictOldest() {
+	var (
+		oldest uint32
+		at     time.Time
+	)
+	for id, p := range r.partials {
+		if at.IsZero() || p.at.Before(at) {
+			oldest, at = id, p.at
+		}
+	}
+	delete(r.partials, oldest)
+}
+
+func (s *session) reassembler(dst bool) *reassembler {
+	if dst {
+		return &s.dstReassembler
+	}
+	return &s.srcReassembler
+}
+
+// outputFragments sends data in fragments within config.FragmentSize and the
+// path MTU, which are scheduled independently, until timeout is closed.
+func (s *session) outputFragments(data []byte, dst bool, timeout <-chan struct{}) error {
+	size := s.maxPayload(dst)
+	if size > s.config.FragmentSize {
+		size = s.config.FragmentSize
+	}
+	size -= fragmentHeaderSize
+	count := (len(data) + size - 1) / size
+	if count > 0xffff {
+		return errDatagramTooLarge
+	}
+	id := s.nextSeq()
+	var err error
+	for i := 0; i < count; i++ {
+		chunk := data[i*size:]
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		buf := getBuffer(fragmentHeaderSize + len(chunk))
+		p := *buf
+		binary.BigEndian.PutUint32(p, id)
+		binary.BigEndian.PutUint16(p[4:], uint16(i))
+		binary.BigEndian.PutUint16(p[6:], uint16(count))
+		copy(p[fragmentHeaderSize:], chunk)
+		e := s.outputFrame(frameFragment, p, dst, timeout)
+		putBuffer(buf)
+		if _, ok := e.(timeoutError); ok {
+			return e
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// fragmentInput inputs the datagram once all its fragments are received.
+func (s *session) fragmentInput(p []byte, dst bool) {
+	if len(p) < fragmentHeaderSize {
+		return
+	}
+	id := binary.BigEndian.Uint32(p)
+	index := int(binary.BigEndian.Uint16(p[4:]))
+	count := int(binary.BigEndian.Uint16(p[6:]))
+	data := s.reassembler(dst).add(id, index, count, p[fragmentHeaderSize:], s.config.MaxWriteSize)
+	if data != nil {
+		s.input(data, id, dst)
+	}
+}
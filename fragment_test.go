@@ -0,0 +1,94 @@
+package mdp
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReassembler(tt *testing.T) {
+	t := require.New(tt)
+	var r reassembler
+	max := 3 * minFragmentChunk
+	t.Nil(r.add(1, 1, 3, []byte("b"), max))
+	t.Nil(r.add(1, 1, 3, []byte("b"), max), "duplicated")
+	t.Nil(r.add(1, 2, 3, []byte("c"), max))
+	t.Nil(r.add(1, 0, 2, []byte("a"), max), "inconsistent count")
+	t.Equal([]byte("abc"), r.add(1, 0, 3, []byte("a"), max))
+	t.Empty(r.partials)
+
+	t.Nil(r.add(2, 3, 3, []byte("x"), max), "index out of range")
+	t.Nil(r.add(2, 0, 2, []byte("xx"), 3))
+	t.Nil(r.add(2, 1, 2, []byte("xx"), 3), "too large")
+	t.Empty(r.partials)
+
+	t.Nil(r.add(3, 0, 0xffff, []byte("x"), max), "more fragments than max takes")
+	t.Nil(r.add(3, 0, 4, []byte("x"), max), "more fragments than max takes")
+	t.Empty(r.partials)
+
+	for id := uint32(0); id <= maxPartialDatagrams; id++ {
+		t.Nil(r.add(id, 0, 2, []byte("x"), max))
+	}
+	t.Len(r.partials, maxPartialDatagrams)
+	t.NotContains(r.partials, uint32(0), "the oldest is evicted")
+}
+
+func testFragment(t *require.Assertions, config Config) {
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+		MaxWriteSize: config.MaxWriteSize,
+	})
+	t.NoError(err)
+	defer server.Close()
+
+	config.IP4 = net.IPv4(127, 0, 0, 1)
+	config.Port = port
+	config.DisableICMDP = true
+	client, err := NewClient(config)
+	t.NoError(err)
+	defer client.Close()
+	waitPaths(t, client, 1)
+
+	_, err = client.Write(make([]byte, config.MaxWriteSize+1))
+	t.Equal(errDatagramTooLarge, err)
+
+	data := make([]byte, config.MaxWriteSize)
+	rand.Read(data)
+	_, err = client.Write(data)
+	t.NoError(err)
+	buf := make([]byte, 2*len(data))
+	t.NoError(server.SetReadDeadline(time.Now().Add(3 * time.Second)))
+	n, addr, err := server.ReadFrom(buf)
+	t.NoError(err)
+	t.True(bytes.Equal(data, buf[:n]), "received %d of %d bytes", n, len(data))
+
+	// and back
+	_, err = server.WriteTo(data, addr)
+	t.NoError(err)
+	t.NoError(client.SetReadDeadline(time.Now().Add(3 * time.Second)))
+	n, err = client.Read(buf)
+	t.NoError(err)
+	t.True(bytes.Equal(data, buf[:n]), "received %d of %d bytes", n, len(data))
+}
+
+func TestFragmentUDP(tt *testing.T) {
+	// a burst of fragments beyond the socket buffer is lost without pacing
+	testFragment(require.New(tt), Config{
+		DisableTCP:   true,
+		MaxWriteSize: 60 << 10,
+	})
+}
+
+func TestFragmentTCP(tt *testing.T) {
+	testFragment(require.New(tt), Config{
+		DisableUDP:   true,
+		MaxWriteSize: 200 << 10,
+		FragmentSize: maxFragmentSize + 1,
+	})
+}
@@ -0,0 +1,139 @@
+package mdp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// frame header:
+// version[4 bits] type[4 bits] flags[1] sessionID[4] nodeID[4] (sequence[4]) payload...
+// sequence presents with flagSequence only.
+const (
+	wireVersion   = 1
+	headerSize    = 2 + sessionIDSize + nodeIDSize
+	maxHeaderSize = headerSize + sequenceSize
+	probeIDSize   = 4
+	versionShift  = 4
+	frameTypeMask = 0x0f
+)
+
+type frameType byte
+
+const (
+	frameData frameType = iota
+	// framePing is a probe or keepalive carrying a probe ID, answered by framePong
+	framePing
+	framePong
+	frameClose
+	// framePathProbe is a padded framePing, answered by an unpadded framePong
+	framePathProbe
+	// frameStream carries a segment of the reliable stream
+	frameStream
+	// frameParity carries the XOR parity of a group of frameData
+	frameParity
+	// frameFragment carries a fragment of a datagram larger than FragmentSize
+	frameFragment
+	// frameRetire tells that the endpoint it arrives on is hopped away from,
+	// so the peer stops outputting on it
+	frameRetire
+)
+
+func (t frameType) String() string {
+	switch t {
+	case frameData:
+		return "DATA"
+	case framePing:
+		return "PING"
+	case framePong:
+		return "PONG"
+	case frameClose:
+		return "CLOSE"
+	case framePathProbe:
+		return "PATH_PROBE"
+	case frameStream:
+		return "STREAM"
+	case frameParity:
+		return "PARITY"
+	case frameFragment:
+		return "FRAGMENT"
+	case frameRetire:
+		return "RETIRE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+const (
+	// flagSequence is set when the sender is in redundant or FEC mode
+	flagSequence byte = 1 << iota
+	// flagAck acknowledges a frameClose or frameRetire
+	flagAck
+	// flagFEC marks a frameData protected by a frameParity
+	flagFEC
+)
+
+var (
+	errShortFrame  = errors.New("mdp: frame too short")
+	errWireVersion = errors.New("mdp: unknown wire version")
+)
+
+type header struct {
+	typ   frameType
+	flags byte
+	sid   uint32
+	nid   uint32
+	seq   uint32
+}
+
+func (h *header) size() int {
+	if h.flags&flagSequence != 0 {
+		return maxHeaderSize
+	}
+	return headerSize
+}
+
+// marshal returns the frame of h followed by payload.
+func (h *header) marshal(payload []byte) []byte {
+	return h.marshalTo(make([]byte, h.size()+len(payload)), payload)
+}
+
+// marshalTo marshals the frame of h followed by payload into p, which is
+// large enough, and returns the frame.
+func (h *header) marshalTo(p []byte, payload []byte) []byte {
+	size := h.size()
+	p = p[:size+len(payload)]
+	p[0] = wireVersion<<versionShift | byte(h.typ)&frameTypeMask
+	p[1] = h.flags
+	binary.BigEndian.PutUint32(p[2:], h.sid)
+	binary.BigEndian.PutUint32(p[6:], h.nid)
+	if size == maxHeaderSize {
+		binary.BigEndian.PutUint32(p[10:], h.seq)
+	}
+	copy(p[size:], payload)
+	return p
+}
+
+func parseFrame(p []byte) (h header, payload []byte, err error) {
+	if len(p) < headerSize {
+		err = errShortFrame
+		return
+	}
+	if p[0]>>versionShift != wireVersion {
+		err = errWireVersion
+		return
+	}
+	h.typ = frameType(p[0] & frameTypeMask)
+	h.flags = p[1]
+	h.sid = binary.BigEndian.Uint32(p[2:])
+	h.nid = binary.BigEndian.Uint32(p[6:])
+	size := h.size()
+	if len(p) < size {
+		err = errShortFrame
+		return
+	}
+	if size == maxHeaderSize {
+		h.seq = binary.BigEndian.Uint32(p[10:])
+	}
+	payload = p[size:]
+	return
+}
@@ -0,0 +1,38 @@
+package mdp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame(tt *testing.T) {
+	t := require.New(tt)
+	h := header{
+		typ: framePong,
+		sid: 0x1,
+		nid: 0x2,
+	}
+	p := h.marshal([]byte("data"))
+	t.Len(p, headerSize+4)
+	parsed, payload, err := parseFrame(p)
+	t.NoError(err)
+	t.Equal(h, parsed)
+	t.Equal([]byte("data"), payload)
+
+	h.typ = frameData
+	h.flags = flagSequence
+	h.seq = 0x3
+	p = h.marshal(nil)
+	t.Len(p, maxHeaderSize)
+	parsed, payload, err = parseFrame(p)
+	t.NoError(err)
+	t.Equal(h, parsed)
+	t.Empty(payload)
+
+	_, _, err = parseFrame(p[:headerSize])
+	t.Equal(errShortFrame, err)
+	p[0] = 0
+	_, _, err = parseFrame(p)
+	t.Equal(errWireVersion, err)
+}
@@ -4,9 +4,10 @@ go 1.16
 
 require (
 	github.com/hashicorp/go-multierror v1.1.1
-	github.com/pkg/errors v0.9.1
 	github.com/poohvpn/icmdp v1.2.0
 	github.com/poohvpn/pooh v0.0.0-19890822053534-f92dff82059a
 	github.com/rs/zerolog v1.23.0
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/net v0.12.0
+	golang.org/x/sys v0.10.0
 )
@@ -0,0 +1,139 @@
+package mdp
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// hopLoop migrates the UDP and TCP dst endpoints to another port of
+// config.HopPorts every config.HopInterval or after config.HopBytes, the old
+// endpoints keep carrying what is in flight for config.HopOverlap.
+func (s *session) hopLoop() {
+	interval := hopCheckInterval
+	if i := s.config.HopInterval; i > 0 && i < interval {
+		interval = i
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	port := s.config.Port
+	hoppedAt := time.Now()
+	hoppedBytes := atomic.LoadUint64(&s.dstBytes)
+	for {
+		select {
+		case <-s.closeOnce.Wait():
+			return
+		case <-ticker.C:
+		}
+		bytes := atomic.LoadUint64(&s.dstBytes)
+		due := s.config.HopInterval > 0 && time.Since(hoppedAt) >= s.config.HopInterval
+		if s.config.HopBytes > 0 && bytes-hoppedBytes >= uint64(s.config.HopBytes) {
+			due = true
+		}
+		if !due {
+			continue
+		}
+		next := nextHopPort(s.config.HopPorts, port)
+		if next != port {
+			go s.retire(s.hop(port, next))
+			port = next
+		}
+		hoppedAt = time.Now()
+		hoppedBytes = bytes
+	}
+}
+
+// hop adds the UDP and TCP dst endpoints on port next, dialing from new
+// source ports, and returns those on port to be retired. These become
+// unavailable at once on both sides, the peer told by frameRetire, so that
+// the output moves to the new ones while replies still arrive on them.
+func (s *session) hop(port, next int) (old []*endpoint) {
+	s.dstEndpoints.Range(func(_, v interface{}) bool {
+		if ep := v.(*endpoint); ep.typ != endpointICMDP && ep.addr.Port == port {
+			old = append(old, ep)
+		}
+		return true
+	})
+	if debug {
+		log.Debug().Uint32("sid", s.config.SessionID).Int("from", port).Int("to", next).Msg("mdp: hop")
+	}
+	addr := s.config.dualStackAddr()
+	addr.Port = next
+	if !s.config.DisableUDP {
+		s.addEndpoints(endpointUDP, addr)
+	}
+	if !s.config.DisableTCP {
+		s.addEndpoints(endpointTCP, addr)
+	}
+	for _, ep := range old {
+		ep.updateHealth(func() {
+			ep.retiring = true
+			ep.retireAck = make(chan struct{})
+		})
+		_ = ep.sendFrame(frameRetire, 0, nil)
+	}
+	return
+}
+
+// retire closes the endpoints hopped away from after config.HopOverlap, once
+// the peer has acknowledged their frameRetire and so sends nothing more on
+// them, or closeRetries*closeTimeout later if it does not. Another
+// frameRetire tells the peer to drop them.
+func (s *session) retire(old []*endpoint) {
+	overlap := time.NewTimer(s.config.HopOverlap)
+	defer overlap.Stop()
+	select {
+	case <-overlap.C:
+	case <-s.closeOnce.Wait():
+	}
+	timeout := newDeadline()
+	timeout.set(time.Now().Add(closeRetries * closeTimeout))
+	defer timeout.set(time.Time{})
+	for _, ep := range old {
+		ep.statM.Lock()
+		ack := ep.retireAck
+		ep.statM.Unlock()
+		select {
+		case <-ack:
+		case <-timeout.wait():
+		case <-s.closeOnce.Wait():
+		}
+		_ = ep.sendFrame(frameRetire, 0, nil)
+		ep.retire()
+	}
+}
+
+// retireAcked handles the acknowledgement of the frameRetire of e.
+func (e *endpoint) retireAcked() {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	if e.retireAck != nil && !isClosedChan(e.retireAck) {
+		close(e.retireAck)
+	}
+}
+
+// nextHopPort picks a port of ports other than port, or port if there is none.
+func nextHopPort(ports []int, port int) int {
+	n := 0
+	for _, p := range ports {
+		if p != port {
+			n++
+		}
+	}
+	if n == 0 {
+		return port
+	}
+	i := rand.Intn(n)
+	for _, p := range ports {
+		if p == port {
+			continue
+		}
+		if i == 0 {
+			return p
+		}
+		i--
+	}
+	return port
+}
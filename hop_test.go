@@ -0,0 +1,110 @@
+package mdp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextHopPort(tt *testing.T) {
+	t := require.New(tt)
+	t.Equal(1, nextHopPort([]int{1}, 1))
+	t.Equal(2, nextHopPort([]int{1, 2}, 1))
+	t.Contains([]int{1, 2}, nextHopPort([]int{1, 2}, 3))
+	for i := 0; i < 100; i++ {
+		t.NotEqual(2, nextHopPort([]int{1, 2, 3}, 2))
+	}
+}
+
+// dstPorts returns the remote ports of the connected dst endpoints.
+func dstPorts(client *Client) map[int]bool {
+	ports := make(map[int]bool)
+	for _, p := range client.Paths() {
+		switch addr := p.RemoteAddr().(type) {
+		case *net.UDPAddr:
+			ports[addr.Port] = true
+		case *net.TCPAddr:
+			ports[addr.Port] = true
+		}
+	}
+	return ports
+}
+
+func testHop(t *require.Assertions, serverConfig ServerConfig, config Config) {
+	ports := []int{freePort(t), freePort(t), freePort(t)}
+	serverConfig.Ports = ports
+	serverConfig.DisableICMDP = true
+	server, err := Listen(serverConfig)
+	t.NoError(err)
+	defer server.Close()
+	go echo(server)
+
+	config.IP4 = net.IPv4(127, 0, 0, 1)
+	config.DisableICMDP = true
+	config.HopPorts = ports
+	config.HopOverlap = 100 * time.Millisecond
+	client, err := NewClient(config)
+	t.NoError(err)
+	defer client.Close()
+	t.Contains(ports, client.sess.config.Port)
+
+	// no datagram is lost across the hops
+	seen := make(map[int]bool)
+	buf := make([]byte, 2000)
+	for i := 0; i < 100; i++ {
+		_, err = client.Write(make([]byte, 1000))
+		t.NoError(err)
+		t.NoError(client.SetReadDeadline(time.Now().Add(time.Second)))
+		n, err := client.Read(buf)
+		t.NoError(err)
+		t.Equal(1000, n)
+		for port := range dstPorts(client) {
+			seen[port] = true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Greater(len(seen), 1)
+	// the old endpoints are retired after the overlap
+	t.Eventually(func() bool {
+		return len(dstPorts(client)) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestHopInterval(tt *testing.T) {
+	testHop(require.New(tt), ServerConfig{}, Config{
+		HopInterval: 200 * time.Millisecond,
+	})
+}
+
+func TestHopRoundRobin(tt *testing.T) {
+	// the server spreads the replies over the endpoints of the client
+	// until told that they are retiring
+	testHop(require.New(tt), ServerConfig{
+		Scheduler: NewRoundRobinScheduler(),
+	}, Config{
+		HopInterval: 200 * time.Millisecond,
+	})
+}
+
+func TestHopBytes(tt *testing.T) {
+	testHop(require.New(tt), ServerConfig{}, Config{
+		DisableTCP: true,
+		HopBytes:   50000,
+	})
+}
+
+func TestSessionExpireEndpoints(tt *testing.T) {
+	t := require.New(tt)
+	sess := newSession(Config{}).setInputAddr(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	t.NoError(err)
+	defer conn.Close()
+	ep := sess.upsertInputPacketConn(endpointUDP, conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	ep.statRecv(1)
+	sess.expireEndpoints(time.Now().Add(-time.Second))
+	t.Len(sess.paths(false), 1)
+	sess.expireEndpoints(time.Now().Add(time.Second))
+	t.Empty(sess.paths(false))
+}
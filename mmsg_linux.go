@@ -0,0 +1,155 @@
+package mdp
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// maxCachedAddrs bounds the source addresses cached by a socket, which is
+// cleared once full, such as by a flood of spoofed sources.
+const maxCachedAddrs = 4096
+
+// mmsghdr is struct mmsghdr of recvmmsg.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// mmsgReader receives batches by recvmmsg into messages whose buffers are
+// fixed. Unlike golang.org/x/net, which allocates the source address of
+// every datagram, it passes the same net.Addr for the datagrams of a peer.
+type mmsgReader struct {
+	rc syscall.RawConn
+	// connected sockets have no source addresses to read
+	connected bool
+	hs        []mmsghdr
+	iovs      []unix.Iovec
+	names     []unix.RawSockaddrInet6
+	addrs     map[addrKey]*net.UDPAddr
+	// n and err are the result of recv, bound once to recvF
+	n     int
+	err   error
+	recvF func(fd uintptr) bool
+}
+
+type addrKey struct {
+	ip   [16]byte
+	port uint16
+	zone uint32
+}
+
+// newMsgReader returns the reader of conn into msgs, or nil.
+func newMsgReader(conn *net.UDPConn, connected bool, msgs []ipv4.Message) msgReader {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	r := &mmsgReader{
+		rc:        rc,
+		connected: connected,
+		hs:        make([]mmsghdr, len(msgs)),
+		iovs:      make([]unix.Iovec, len(msgs)),
+		names:     make([]unix.RawSockaddrInet6, len(msgs)),
+		addrs:     make(map[addrKey]*net.UDPAddr),
+	}
+	r.recvF = r.recv
+	for i := range msgs {
+		buf := msgs[i].Buffers[0]
+		r.iovs[i].Base = &buf[0]
+		r.iovs[i].SetLen(len(buf))
+		h := &r.hs[i].hdr
+		h.Iov = &r.iovs[i]
+		h.SetIovlen(1)
+		if !connected {
+			h.Name = (*byte)(unsafe.Pointer(&r.names[i]))
+		}
+		if len(msgs[i].OOB) > 0 {
+			h.Control = &msgs[i].OOB[0]
+		}
+	}
+	return r
+}
+
+func (r *mmsgReader) readMsgs(msgs []ipv4.Message) (int, error) {
+	for i := range r.hs {
+		h := &r.hs[i].hdr
+		if !r.connected {
+			h.Namelen = unix.SizeofSockaddrInet6
+		}
+		h.SetControllen(len(msgs[i].OOB))
+		h.Flags = 0
+	}
+	r.n, r.err = 0, nil
+	if err := r.rc.Read(r.recvF); err != nil {
+		return 0, err
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	for i := 0; i < r.n; i++ {
+		m := &msgs[i]
+		m.N = int(r.hs[i].len)
+		m.NN = int(r.hs[i].hdr.Controllen)
+		m.Addr = nil
+		if !r.connected {
+			m.Addr = r.addr(&r.names[i])
+		}
+	}
+	return r.n, nil
+}
+
+func (r *mmsgReader) recv(fd uintptr) bool {
+	n, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&r.hs[0])), uintptr(len(r.hs)), 0, 0, 0)
+	if errno == unix.EAGAIN {
+		return false
+	}
+	if errno != 0 {
+		r.err = errno
+		return true
+	}
+	r.n = int(n)
+	return true
+}
+
+// addr returns the cached address of name.
+func (r *mmsgReader) addr(name *unix.RawSockaddrInet6) net.Addr {
+	var key addrKey
+	b := (*[unix.SizeofSockaddrInet6]byte)(unsafe.Pointer(name))
+	key.port = binary.BigEndian.Uint16(b[2:4])
+	ipLen := net.IPv6len
+	switch name.Family {
+	case unix.AF_INET:
+		ipLen = net.IPv4len
+		copy(key.ip[:], b[4:8])
+	case unix.AF_INET6:
+		copy(key.ip[:], name.Addr[:])
+		key.zone = name.Scope_id
+	default:
+		return nil
+	}
+	if addr, ok := r.addrs[key]; ok {
+		return addr
+	}
+	if len(r.addrs) >= maxCachedAddrs {
+		r.addrs = make(map[addrKey]*net.UDPAddr)
+	}
+	addr := &net.UDPAddr{
+		IP:   append(net.IP(nil), key.ip[:ipLen]...),
+		Port: int(key.port),
+	}
+	if key.zone != 0 {
+		if ifi, err := net.InterfaceByIndex(int(key.zone)); err == nil {
+			addr.Zone = ifi.Name
+		} else {
+			addr.Zone = strconv.Itoa(int(key.zone))
+		}
+	}
+	r.addrs[key] = addr
+	return addr
+}
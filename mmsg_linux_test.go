@@ -0,0 +1,44 @@
+package mdp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMmsgReaderAddrs(tt *testing.T) {
+	t := require.New(tt)
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback} {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		t.NoError(err)
+		receiver := newBatchConn(conn, nil)
+		var senders []*net.UDPConn
+		for i := 0; i < 2; i++ {
+			sender, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+			t.NoError(err)
+			defer sender.Close()
+			senders = append(senders, sender)
+			for j := 0; j < 2; j++ {
+				_, err = sender.Write([]byte("hello"))
+				t.NoError(err)
+			}
+		}
+
+		// the datagrams of a peer share its address
+		var addrs []net.Addr
+		t.NoError(receiver.SetReadDeadline(time.Now().Add(time.Second)))
+		t.NoError(receiver.readPackets(func(p []byte, addr net.Addr) bool {
+			addrs = append(addrs, addr)
+			return len(addrs) < 4
+		}))
+		t.Same(addrs[0], addrs[1])
+		t.Same(addrs[2], addrs[3])
+		t.NotSame(addrs[0], addrs[2])
+		for i, sender := range senders {
+			t.True(sameAddr(sender.LocalAddr(), addrs[2*i]), addrs[2*i])
+		}
+		t.NoError(receiver.Close())
+	}
+}
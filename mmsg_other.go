@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package mdp
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// newMsgReader returns nil, batches are read by golang.org/x/net.
+func newMsgReader(conn *net.UDPConn, connected bool, msgs []ipv4.Message) msgReader {
+	return nil
+}
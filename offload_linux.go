@@ -0,0 +1,57 @@
+package mdp
+
+import (
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// groOOBSize fits the UDP_GRO control message.
+var groOOBSize = unix.CmsgSpace(4)
+
+// enableOffload reports whether the kernel supports UDP GSO on conn, and
+// enables UDP GRO on it if supported.
+func enableOffload(conn *net.UDPConn) (gso, gro bool) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	_ = rc.Control(func(fd uintptr) {
+		_, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_SEGMENT)
+		gso = err == nil
+		gro = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO, 1) == nil
+	})
+	return
+}
+
+// gsoOOB returns the UDP_SEGMENT control message of segments of size in b
+// if it has the capacity.
+func gsoOOB(b []byte, size int) []byte {
+	if n := unix.CmsgSpace(2); cap(b) < n {
+		b = make([]byte, n)
+	} else {
+		b = b[:n]
+	}
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = unix.UDP_SEGMENT
+	h.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&b[unix.CmsgLen(0)])) = uint16(size)
+	return b
+}
+
+// groSegmentSize returns the segment size of a datagram coalesced by UDP
+// GRO from its control messages, or 0.
+func groSegmentSize(oob []byte) int {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range msgs {
+		if m.Header.Level == unix.IPPROTO_UDP && m.Header.Type == unix.UDP_GRO && len(m.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		}
+	}
+	return 0
+}
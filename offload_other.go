@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package mdp
+
+import "net"
+
+const groOOBSize = 0
+
+// enableOffload reports that UDP GSO and GRO are Linux only.
+func enableOffload(conn *net.UDPConn) (gso, gro bool) {
+	return
+}
+
+func gsoOOB(b []byte, size int) []byte {
+	return nil
+}
+
+func groSegmentSize(oob []byte) int {
+	return 0
+}
@@ -0,0 +1,181 @@
+package mdp
+
+import (
+	"time"
+
+	"github.com/poohvpn/pooh"
+)
+
+// Packetization layer path MTU discovery in the manner of RFC 8899: dst
+// endpoints binary search the largest frame the path carries by padded
+// framePathProbe, which counts as lost after maxProbeLosses unanswered
+// probes of a size. The peer takes the size of the path probes it receives
+// as the MTU of its side, assuming the path is symmetric. UDP sockets set
+// DF, see dontFragment, so probes are never fragmented on the way.
+//
+// The MTU is the size of a frame, excluding IP, UDP and ICMP headers.
+const (
+	// basePathMTU fits the minimal IPv6 MTU of 1280 with IPv6 and UDP or
+	// ICMP headers
+	basePathMTU = 1280 - 40 - 8
+	maxPathMTU4 = 1500 - 20 - 8
+	maxPathMTU6 = 1500 - 40 - 8
+	// tcpPathMTU is limited by the length prefix of tcpDatagram
+	tcpPathMTU = 0xffff
+	// pmtuResolution stops the search when the bounds are that close
+	pmtuResolution = 16
+	// pmtuRaiseInterval searches again for a larger MTU
+	pmtuRaiseInterval = 10 * time.Minute
+)
+
+// MTU returns the largest frame the path carries.
+func (e *endpoint) MTU() int {
+	if e.typ == endpointTCP {
+		return tcpPathMTU
+	}
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	if e.mtu == 0 {
+		return basePathMTU
+	}
+	return e.mtu
+}
+
+func (e *endpoint) maxPathMTU() int {
+	if pooh.IsIPv4(e.addr.IP) {
+		return maxPathMTU4
+	}
+	return maxPathMTU6
+}
+
+// probeMTU sends the next path probe of the search, or counts the probe in
+// flight as lost after probeTimeout.
+func (e *endpoint) probeMTU() error {
+	if e.typ == endpointTCP {
+		return nil
+	}
+	now := time.Now()
+	e.statM.Lock()
+	if e.mtu == 0 {
+		e.mtu = basePathMTU
+		e.pmtuHigh = e.maxPathMTU() + 1
+	}
+	if e.pmtuProbe != 0 {
+		if now.Sub(e.pmtuSentAt) < probeTimeout {
+			e.statM.Unlock()
+			return nil
+		}
+		e.pmtuLosses++
+		if e.pmtuLosses >= maxProbeLosses {
+			e.pmtuHigh = e.pmtuProbe
+			e.pmtuLosses = 0
+			if e.pmtuHigh-e.mtu <= pmtuResolution {
+				e.pmtuDoneAt = now
+			}
+		}
+	}
+	if e.pmtuHigh-e.mtu <= pmtuResolution {
+		if now.Sub(e.pmtuDoneAt) < pmtuRaiseInterval {
+			e.pmtuProbe = 0
+			e.statM.Unlock()
+			return nil
+		}
+		e.pmtuHigh = e.maxPathMTU() + 1
+	}
+	size := (e.mtu + e.pmtuHigh) / 2
+	e.probeID++
+	if e.probeID == 0 {
+		e.probeID++
+	}
+	id := e.probeID
+	e.pmtuProbe = size
+	e.pmtuProbeID = id
+	e.pmtuSentAt = now
+	e.statM.Unlock()
+
+	payload := make([]byte, size-headerSize)
+	copy(payload, pooh.Uint322Bytes(id))
+	err := e.sendFrame(framePathProbe, 0, payload)
+	if err != nil {
+		// too large to send at all, such as EMSGSIZE
+		e.statM.Lock()
+		if e.pmtuProbeID == id {
+			e.pmtuHigh = size
+			e.pmtuProbe = 0
+			e.pmtuLosses = 0
+		}
+		e.statM.Unlock()
+	}
+	return err
+}
+
+// resetMTU restarts the search on a new conn.
+func (e *endpoint) resetMTU() {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	e.mtu = 0
+	e.pmtuProbe = 0
+	e.pmtuLosses = 0
+}
+
+// pathProbed handles the echo of path probe id.
+func (e *endpoint) pathProbed(id uint32) {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	if e.pmtuProbe == 0 || e.pmtuProbeID != id {
+		return
+	}
+	e.mtu = e.pmtuProbe
+	e.pmtuProbe = 0
+	e.pmtuLosses = 0
+	if e.pmtuHigh-e.mtu <= pmtuResolution {
+		e.pmtuDoneAt = time.Now()
+	}
+}
+
+// raiseMTU takes the size of a received path probe as the MTU of a src endpoint.
+func (e *endpoint) raiseMTU(size int) {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	if size > e.mtu && size > basePathMTU {
+		e.mtu = size
+	}
+}
+
+// maxPayload returns the largest payload of a frame on the side of dst,
+// which is limited by the smallest MTU of the paths schedule chooses from,
+// the available ones or else the connected ones, so that the frames go
+// wherever the scheduler and redundancy put them.
+func (s *session) maxPayload(dst bool) int {
+	mtu, availableMTU := 0, 0
+	s.rangePaths(dst, func(ep *endpoint) {
+		m := ep.MTU()
+		if mtu == 0 || m < mtu {
+			mtu = m
+		}
+		if ep.Available() && (availableMTU == 0 || m < availableMTU) {
+			availableMTU = m
+		}
+	})
+	if availableMTU > 0 {
+		mtu = availableMTU
+	}
+	if mtu == 0 {
+		mtu = basePathMTU
+	}
+	return mtu - maxHeaderSize
+}
+
+// maxDatagramSize returns the largest datagram sent unfragmented on the side
+// of dst.
+func (s *session) maxDatagramSize(dst bool) int {
+	size := s.maxPayload(dst)
+	if k := s.config.FECGroupSize; k > 1 {
+		// the parity of the group has to fit as well
+		size -= 1 + sequenceSize*k + 2
+	}
+	if size > s.config.FragmentSize {
+		size = s.config.FragmentSize
+	}
+	return size
+}
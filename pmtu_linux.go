@@ -0,0 +1,31 @@
+package mdp
+
+import (
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dontFragment is a Control setting DF on UDP sockets without regard to the
+// path MTU learned by the kernel, so that a path probe beyond the path MTU
+// is lost instead of fragmented, and one beyond the device MTU fails.
+func dontFragment(network, address string, c syscall.RawConn) error {
+	if !strings.HasPrefix(network, "udp") {
+		return nil
+	}
+	var err error
+	if e := c.Control(func(fd uintptr) {
+		if network == "udp6" {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+			if err != nil {
+				return
+			}
+		}
+		// also of IPv4-mapped addresses on a dual stack socket
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+	}); e != nil {
+		return e
+	}
+	return err
+}
@@ -0,0 +1,30 @@
+package mdp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestDontFragment(tt *testing.T) {
+	t := require.New(tt)
+	for _, address := range []string{"127.0.0.1:9", "[::1]:9"} {
+		conn, err := (&net.Dialer{Control: dontFragment}).Dial("udp", address)
+		t.NoError(err)
+		raw, err := conn.(*net.UDPConn).SyscallConn()
+		t.NoError(err)
+		t.NoError(raw.Control(func(fd uintptr) {
+			mode, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+			t.NoError(err)
+			t.Equal(unix.IP_PMTUDISC_PROBE, mode)
+			if address[0] == '[' {
+				mode, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER)
+				t.NoError(err)
+				t.Equal(unix.IPV6_PMTUDISC_PROBE, mode)
+			}
+		}))
+		t.NoError(conn.Close())
+	}
+}
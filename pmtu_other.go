@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package mdp
+
+import "syscall"
+
+// dontFragment leaves fragmentation to the platform, where path probes
+// beyond the path MTU may be fragmented and overestimate it.
+func dontFragment(network, address string, c syscall.RawConn) error {
+	return nil
+}
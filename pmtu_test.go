@@ -0,0 +1,164 @@
+package mdp
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testPMTU(t *require.Assertions, mtu int) {
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		IP4:           net.IPv4(127, 0, 0, 1),
+		Port:          port,
+		DisableICMDP:  true,
+		ProbeInterval: 20 * time.Millisecond,
+		Obfuscator:    testObfuscator{mtu: mtu},
+	})
+	t.NoError(err)
+	defer client.Close()
+
+	for _, p := range client.Paths() {
+		if p.Network() == "tcp" {
+			t.Equal(tcpPathMTU, p.MTU())
+		} else {
+			t.Equal(basePathMTU, p.MTU())
+		}
+	}
+	udpMTU := func() int {
+		for _, p := range client.Paths() {
+			if p.Network() == "udp" {
+				return p.MTU()
+			}
+		}
+		return 0
+	}
+	t.Eventually(func() bool {
+		return udpMTU() > mtu-pmtuResolution
+	}, 2*time.Second, 10*time.Millisecond)
+	t.LessOrEqual(udpMTU(), mtu)
+
+	// the largest datagram fits the UDP path as well as the TCP one
+	t.Equal(udpMTU()-maxHeaderSize, client.MaxDatagramSize())
+	_, err = client.Write([]byte("hello"))
+	t.NoError(err)
+	t.NoError(server.SetReadDeadline(time.Now().Add(time.Second)))
+	_, addr, err := server.ReadFrom(make([]byte, 10))
+	t.NoError(err)
+	t.Equal(udpMTU()-maxHeaderSize, server.MaxDatagramSize(addr))
+	server.rangeSessions(func(sess *session) {
+		sess.srcEndpoints.Range(func(_, v interface{}) bool {
+			if ep := v.(*endpoint); ep.typ == endpointUDP {
+				t.Equal(udpMTU(), ep.MTU(), "taken from the path probes")
+			}
+			return true
+		})
+	})
+}
+
+func TestPMTU(tt *testing.T) {
+	testPMTU(require.New(tt), maxPathMTU4)
+}
+
+func TestPMTULimited(tt *testing.T) {
+	testPMTU(require.New(tt), 1300)
+}
+
+func TestPMTUFragment(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+
+	const mtu = 1300
+	client, err := NewClient(Config{
+		IP4:           net.IPv4(127, 0, 0, 1),
+		Port:          port,
+		DisableICMDP:  true,
+		DisableTCP:    true,
+		ProbeInterval: 20 * time.Millisecond,
+		Obfuscator:    testObfuscator{mtu: mtu},
+	})
+	t.NoError(err)
+	defer client.Close()
+
+	t.Eventually(func() bool {
+		return client.MaxDatagramSize() > mtu-pmtuResolution-maxHeaderSize
+	}, 2*time.Second, 10*time.Millisecond)
+	t.LessOrEqual(client.MaxDatagramSize(), mtu-maxHeaderSize)
+
+	// datagrams beyond the path MTU are fragmented instead of failing
+	data := make([]byte, 1400)
+	rand.Read(data)
+	_, err = client.Write(data)
+	t.NoError(err)
+	buf := make([]byte, 2000)
+	t.NoError(server.SetReadDeadline(time.Now().Add(time.Second)))
+	n, _, err := server.ReadFrom(buf)
+	t.NoError(err)
+	t.True(bytes.Equal(data, buf[:n]))
+}
+
+func TestPMTUFragmentMixed(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+
+	var udpFragments int32
+	client, err := NewClient(Config{
+		IP4:          net.IPv4(127, 0, 0, 1),
+		Port:         port,
+		DisableICMDP: true,
+		Scheduler:    NewRoundRobinScheduler(),
+		Redundancy:   2,
+		Obfuscator: testObfuscator{drop: dropFrames(func(h header) bool {
+			if h.typ == frameFragment {
+				atomic.AddInt32(&udpFragments, 1)
+			}
+			return false
+		})},
+	})
+	t.NoError(err)
+	defer client.Close()
+	waitPaths(t, client, 2)
+
+	// datagrams beyond the UDP path MTU are fragmented over both paths
+	// rather than all sent over TCP
+	t.Less(client.MaxDatagramSize(), 4000)
+	const count = 20
+	data := make([]byte, 4000)
+	for i := 0; i < count; i++ {
+		rand.Read(data)
+		_, err = client.Write(data)
+		t.NoError(err)
+	}
+	buf := make([]byte, 8000)
+	t.NoError(server.SetReadDeadline(time.Now().Add(time.Second)))
+	for i := 0; i < count; i++ {
+		n, _, err := server.ReadFrom(buf)
+		t.NoError(err)
+		t.Equal(len(data), n)
+	}
+	t.Greater(atomic.LoadInt32(&udpFragments), int32(count))
+}
@@ -0,0 +1,134 @@
+package mdp
+
+import (
+	"time"
+
+	"github.com/poohvpn/pooh"
+)
+
+// probe sends a framePing as keepalive carrying a probe ID, the peer echoes
+// it back by framePong to measure RTT, jitter and loss of the endpoint.
+func (e *endpoint) probe() error {
+	now := time.Now()
+	e.statM.Lock()
+	e.probeID++
+	if e.probeID == 0 {
+		e.probeID++
+	}
+	id := e.probeID
+	if e.probes == nil {
+		e.probes = make(map[uint32]sentProbe)
+	}
+	// including the ping itself
+	e.lastProbeSent = e.sendCount + 1
+	e.probes[id] = sentProbe{
+		at:   now,
+		sent: e.lastProbeSent,
+	}
+	e.lastProbe = now
+	e.statM.Unlock()
+
+	return e.sendFrame(framePing, 0, pooh.Uint322Bytes(id))
+}
+
+type sentProbe struct {
+	at   time.Time
+	sent int // frames sent on the endpoint
+}
+
+// probed handles the echo of probe id, peerRecv is the number of frames the
+// peer has received on the endpoint, negative if not reported.
+func (e *endpoint) probed(id uint32, peerRecv int) {
+	now := time.Now()
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	p, ok := e.probes[id]
+	if !ok {
+		// expired or duplicated
+		return
+	}
+	delete(e.probes, id)
+	e.statLoss(false)
+
+	rtt := now.Sub(p.at)
+	if peerRecv >= 0 {
+		e.feedback(p.sent, peerRecv, rtt)
+	}
+	if e.srtt == 0 {
+		// RFC 6298
+		e.srtt = rtt
+		e.rttVar = rtt / 2
+	} else {
+		e.rttVar = (3*e.rttVar + abs(e.srtt-rtt)) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+		// RFC 3550
+		e.jitter += (abs(rtt-e.lastRTT) - e.jitter) / 16
+	}
+	e.lastRTT = rtt
+}
+
+// expireProbes counts the probes unanswered for probeTimeout as lost.
+func (e *endpoint) expireProbes() {
+	now := time.Now()
+	e.updateHealth(func() {
+		for id, p := range e.probes {
+			if now.Sub(p.at) >= probeTimeout {
+				delete(e.probes, id)
+				e.statLoss(true)
+				e.probeLosses++
+			}
+		}
+	})
+}
+
+func (e *endpoint) statLoss(lost bool) {
+	var sample float64
+	if lost {
+		sample = 1
+	}
+	e.loss += (sample - e.loss) / 8
+}
+
+func (e *endpoint) RTT() time.Duration {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	return e.srtt
+}
+
+func (e *endpoint) RTTVar() time.Duration {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	return e.rttVar
+}
+
+func (e *endpoint) Jitter() time.Duration {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	return e.jitter
+}
+
+// RecvCount returns the number of frames received on the endpoint.
+func (e *endpoint) RecvCount() int {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	return e.recvCount
+}
+
+func (e *endpoint) Loss() float64 {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	return e.loss
+}
+
+func (e *endpoint) LastProbe() time.Time {
+	e.statM.Lock()
+	defer e.statM.Unlock()
+	return e.lastProbe
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
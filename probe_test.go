@@ -0,0 +1,24 @@
+package mdp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointProbe(tt *testing.T) {
+	t := assert.New(tt)
+	e := &endpoint{}
+	e.probes = map[uint32]sentProbe{
+		1: {at: time.Now().Add(-10 * time.Millisecond)},
+		2: {at: time.Now().Add(-probeTimeout)},
+	}
+	e.probed(1, -1)
+	t.InDelta(float64(10*time.Millisecond), float64(e.RTT()), float64(5*time.Millisecond))
+	t.Zero(e.Loss())
+	e.probed(1, -1)
+	e.expireProbes()
+	t.Equal(1.0/8, e.Loss())
+	t.Empty(e.probes)
+}
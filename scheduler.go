@@ -0,0 +1,172 @@
+package mdp
+
+import (
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Path is a connected endpoint of a session as seen by a Scheduler.
+type Path interface {
+	// Network returns "udp", "tcp" or "icmdp".
+	Network() string
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	LastRecv() time.Time
+	LastSent() time.Time
+	// RTT returns the smoothed round trip time, zero if not measured yet,
+	// which is only measured on the probing side of a session.
+	RTT() time.Duration
+	// RTTVar returns the round trip time variation.
+	RTTVar() time.Duration
+	// Jitter returns the mean deviation of consecutive round trip times.
+	Jitter() time.Duration
+	// Loss returns the smoothed probe loss rate between 0 and 1.
+	Loss() float64
+	// Throughput returns the received bytes per second.
+	Throughput() float64
+	// MTU returns the largest frame the path carries, as discovered by
+	// probing on the probing side of a session.
+	MTU() int
+	// Available reports whether the path is healthy, unavailable paths are
+	// quarantined from scheduling until they are proven again.
+	Available() bool
+}
+
+// Scheduler picks the path of a session to send the next datagram on.
+// Schedule is called concurrently by all sessions sharing the Scheduler,
+// paths is never empty and the result must be one of paths or nil.
+type Scheduler interface {
+	Schedule(paths []Path) Path
+}
+
+// NewMostRecentScheduler sends on the path which received last, so replies
+// follow the path the peer is currently using.
+func NewMostRecentScheduler() Scheduler {
+	return mostRecentScheduler{}
+}
+
+type mostRecentScheduler struct{}
+
+func (mostRecentScheduler) Schedule(paths []Path) Path {
+	return mostRecent(paths)
+}
+
+func mostRecent(paths []Path) (res Path) {
+	var t time.Time
+	for _, p := range paths {
+		if lastRecv := p.LastRecv(); res == nil || lastRecv.After(t) {
+			t = lastRecv
+			res = p
+		}
+	}
+	return
+}
+
+// NewRoundRobinScheduler spreads datagrams evenly over all paths to
+// aggregate their bandwidth.
+func NewRoundRobinScheduler() Scheduler {
+	return &roundRobinScheduler{}
+}
+
+type roundRobinScheduler struct {
+	next uint64
+}
+
+func (s *roundRobinScheduler) Schedule(paths []Path) Path {
+	return paths[(atomic.AddUint64(&s.next, 1)-1)%uint64(len(paths))]
+}
+
+// NewLowestRTTScheduler sends on the path with the lowest smoothed RTT,
+// paths without RTT measurement are only used when none is measured.
+func NewLowestRTTScheduler() Scheduler {
+	return lowestRTTScheduler{}
+}
+
+type lowestRTTScheduler struct{}
+
+func (lowestRTTScheduler) Schedule(paths []Path) (res Path) {
+	var min time.Duration
+	for _, p := range paths {
+		if rtt := p.RTT(); rtt > 0 && (res == nil || rtt < min) {
+			min = rtt
+			res = p
+		}
+	}
+	if res == nil {
+		res = mostRecent(paths)
+	}
+	return
+}
+
+// NewThroughputScheduler picks paths randomly weighted by their received
+// throughput, so faster paths carry proportionally more datagrams.
+func NewThroughputScheduler() Scheduler {
+	return throughputScheduler{}
+}
+
+type throughputScheduler struct{}
+
+func (throughputScheduler) Schedule(paths []Path) Path {
+	var sum float64
+	for _, p := range paths {
+		sum += throughputWeight(p)
+	}
+	r := rand.Float64() * sum
+	for _, p := range paths {
+		r -= throughputWeight(p)
+		if r < 0 {
+			return p
+		}
+	}
+	return paths[len(paths)-1]
+}
+
+// throughputWeight keeps idle paths in rotation with a minimal weight.
+func throughputWeight(p Path) float64 {
+	return p.Throughput() + 1
+}
+
+// NewPrimaryScheduler sends on the first alive path in the order of the
+// given networks, falling back to the next one when a path has received
+// nothing within timeout. Networks not listed are used as the last resort.
+func NewPrimaryScheduler(timeout time.Duration, networks ...string) Scheduler {
+	return &primaryScheduler{
+		timeout:  timeout,
+		networks: networks,
+	}
+}
+
+type primaryScheduler struct {
+	timeout  time.Duration
+	networks []string
+}
+
+func (s *primaryScheduler) Schedule(paths []Path) Path {
+	now := time.Now()
+	alive := func(p Path) bool {
+		return now.Sub(p.LastRecv()) < s.timeout
+	}
+	for _, network := range s.networks {
+		for _, p := range paths {
+			if p.Network() == network && alive(p) {
+				return p
+			}
+		}
+	}
+	for _, p := range paths {
+		if alive(p) {
+			return p
+		}
+	}
+	// nothing is alive, probe the primary path first
+	for _, network := range s.networks {
+		for _, p := range paths {
+			if p.Network() == network {
+				return p
+			}
+		}
+	}
+	return mostRecent(paths)
+}
@@ -0,0 +1,92 @@
+package mdp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testPath struct {
+	network    string
+	lastRecv   time.Time
+	rtt        time.Duration
+	throughput float64
+}
+
+func (p *testPath) Network() string       { return p.network }
+func (p *testPath) LocalAddr() net.Addr   { return nil }
+func (p *testPath) RemoteAddr() net.Addr  { return nil }
+func (p *testPath) LastRecv() time.Time   { return p.lastRecv }
+func (p *testPath) LastSent() time.Time   { return time.Time{} }
+func (p *testPath) RTT() time.Duration    { return p.rtt }
+func (p *testPath) RTTVar() time.Duration { return 0 }
+func (p *testPath) Jitter() time.Duration { return 0 }
+func (p *testPath) Loss() float64         { return 0 }
+func (p *testPath) Throughput() float64   { return p.throughput }
+func (p *testPath) Available() bool       { return true }
+func (p *testPath) MTU() int              { return basePathMTU }
+
+func TestMostRecentScheduler(tt *testing.T) {
+	t := require.New(tt)
+	now := time.Now()
+	paths := []Path{
+		&testPath{lastRecv: now.Add(-time.Second)},
+		&testPath{lastRecv: now},
+		&testPath{},
+	}
+	t.Equal(paths[1], NewMostRecentScheduler().Schedule(paths))
+}
+
+func TestRoundRobinScheduler(tt *testing.T) {
+	t := require.New(tt)
+	paths := []Path{&testPath{}, &testPath{}, &testPath{}}
+	s := NewRoundRobinScheduler()
+	for i := 0; i < 6; i++ {
+		t.Equal(paths[i%3], s.Schedule(paths))
+	}
+}
+
+func TestLowestRTTScheduler(tt *testing.T) {
+	t := require.New(tt)
+	paths := []Path{
+		&testPath{rtt: 30 * time.Millisecond},
+		&testPath{},
+		&testPath{rtt: 10 * time.Millisecond},
+	}
+	t.Equal(paths[2], NewLowestRTTScheduler().Schedule(paths))
+	t.Equal(paths[1], NewLowestRTTScheduler().Schedule(paths[1:2]))
+}
+
+func TestThroughputScheduler(tt *testing.T) {
+	t := require.New(tt)
+	paths := []Path{
+		&testPath{throughput: 99},
+		&testPath{},
+	}
+	s := NewThroughputScheduler()
+	counts := make(map[Path]int)
+	for i := 0; i < 1000; i++ {
+		counts[s.Schedule(paths)]++
+	}
+	t.Greater(counts[paths[0]], counts[paths[1]]*10)
+	t.Greater(counts[paths[1]], 0)
+}
+
+func TestPrimaryScheduler(tt *testing.T) {
+	t := require.New(tt)
+	now := time.Now()
+	udp := &testPath{network: "udp", lastRecv: now}
+	tcp := &testPath{network: "tcp", lastRecv: now}
+	icmdp := &testPath{network: "icmdp", lastRecv: now}
+	paths := []Path{icmdp, tcp, udp}
+	s := NewPrimaryScheduler(time.Second, "udp", "tcp")
+	t.Equal(udp, s.Schedule(paths))
+	udp.lastRecv = now.Add(-time.Minute)
+	t.Equal(tcp, s.Schedule(paths))
+	tcp.lastRecv = now.Add(-time.Minute)
+	t.Equal(icmdp, s.Schedule(paths))
+	icmdp.lastRecv = now.Add(-time.Minute)
+	t.Equal(udp, s.Schedule(paths))
+}
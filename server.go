@@ -1,9 +1,16 @@
 package mdp
 
 import (
+	"container/list"
+	"context"
+	"errors"
 	"io"
 	"net"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/poohvpn/icmdp"
@@ -11,58 +18,232 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-func Listen(port int) (s *Server, err error) {
+type ServerConfig struct {
+	Port int
+	// Ports are listened on besides Port for TCP and UDP, all feeding the
+	// same sessions, such as PortRange(20000, 20100) for clients hopping
+	// across ports. Port is not listened on if it is zero then.
+	Ports  []int
+	NodeID uint32
+	// DisableICMDP neither listens on ICMDP nor relays to other nodes by it.
+	DisableICMDP bool
+	Obfuscator   Obfuscator
+	Scheduler    Scheduler
+	Redundancy   int
+	FECGroupSize int
+	// MaxWriteSize and FragmentSize are as in Config.
+	MaxWriteSize int
+	FragmentSize int
+	// OnPathStateChange is called when a path of a session becomes
+	// available or unavailable, it must not block.
+	OnPathStateChange func(path Path, available bool)
+	// CongestionControl and DisableCongestionControl are as in Config.
+	CongestionControl        func() CongestionControl
+	DisableCongestionControl bool
+	// IdleTimeout closes sessions which have received nothing for that
+	// long, zero means defaultIdleTimeout and negative never closes them.
+	IdleTimeout time.Duration
+	// MaxSessions evicts the least recently active session when exceeded,
+	// zero means unlimited.
+	MaxSessions int
+	// Workers is the number of goroutines handling the packets received on
+	// UDP and ICMDP, which are sharded by session so the packets of a
+	// session are handled in order, zero means runtime.NumCPU().
+	Workers int
+	// WorkerQueueSize is the number of packets queued to a worker, beyond
+	// which packets are dropped and counted by Server.Drops, zero means
+	// queueSize.
+	WorkerQueueSize int
+	// Sockets is the number of UDP sockets and TCP listeners opened on Port
+	// with SO_REUSEPORT, each read by its own goroutine, so the kernel
+	// spreads flows across cores. Zero means a single one without
+	// SO_REUSEPORT.
+	Sockets int
+	// Control, FwMark and BindToDevice are as in Config, applied to the
+	// listeners and the sockets relaying to other nodes.
+	Control      func(network, address string, c syscall.RawConn) error
+	FwMark       int
+	BindToDevice string
+}
+
+func (c *ServerConfig) def() ServerConfig {
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = defaultIdleTimeout
+	}
+	if c.MaxSessions < 0 {
+		c.MaxSessions = 0
+	}
+	if c.Workers <= 0 {
+		c.Workers = runtime.NumCPU()
+	}
+	if c.WorkerQueueSize <= 0 {
+		c.WorkerQueueSize = queueSize
+	}
+	if c.Sockets <= 0 {
+		c.Sockets = 1
+	}
+	if socketControl(c.Control, c.FwMark, c.BindToDevice) != nil {
+		c.DisableICMDP = true
+	}
+	return *c
+}
+
+// ports returns the distinct ports to listen on.
+func (c *ServerConfig) ports() []int {
+	if len(c.Ports) == 0 {
+		return []int{c.Port}
+	}
+	var ports []int
+	seen := make(map[int]bool)
+	if c.Port != 0 {
+		ports = append(ports, c.Port)
+		seen[c.Port] = true
+	}
+	for _, port := range c.Ports {
+		if !seen[port] {
+			ports = append(ports, port)
+			seen[port] = true
+		}
+	}
+	return ports
+}
+
+func Listen(config ServerConfig) (s *Server, err error) {
+	config = config.def()
 	s = &Server{
-		session: newSession(Config{}).
+		config: config,
+		session: newSession(Config{
+			NodeID:                   config.NodeID,
+			DisableICMDP:             config.DisableICMDP,
+			Obfuscator:               config.Obfuscator,
+			Scheduler:                config.Scheduler,
+			Redundancy:               config.Redundancy,
+			FECGroupSize:             config.FECGroupSize,
+			MaxWriteSize:             config.MaxWriteSize,
+			FragmentSize:             config.FragmentSize,
+			OnPathStateChange:        config.OnPathStateChange,
+			CongestionControl:        config.CongestionControl,
+			DisableCongestionControl: config.DisableCongestionControl,
+			Control:                  config.Control,
+			FwMark:                   config.FwMark,
+			BindToDevice:             config.BindToDevice,
+		}).
 			setSrcInputCh(nil).
+			setAcceptCh(nil).
 			setInputAddr(&Addr{
-				Port: port,
+				Port: config.ports()[0],
 			}),
+		lruSessions:   list.New(),
+		lruElements:   make(map[*session]*list.Element),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
 	}
-	s.tcpListener, err = net.ListenTCP("tcp", &net.TCPAddr{
-		Port: port,
-	})
-	if err != nil {
-		return
-	}
-	s.udpListener, err = net.ListenUDP("udp", &net.UDPAddr{
-		Port: port,
-	})
+	defer func() {
+		if err != nil {
+			_ = s.close()
+			s = nil
+		}
+	}()
+	err = s.listen()
 	if err != nil {
 		return
 	}
-	s.icmpV4Conn, err = icmdp.ListenICMDP("icmdp4", nil)
-	if err != nil {
-		log.Warn().Err(err).Msg("listen icmdp4")
-		err = nil
-	}
-	s.icmpV6Conn, err = icmdp.ListenICMDP("icmdp6", nil)
-	if err != nil {
-		log.Warn().Err(err).Msg("listen icmdp6")
-		err = nil
+	if !config.DisableICMDP {
+		s.icmpV4Conn, err = icmdp.ListenICMDP("icmdp4", nil)
+		if err != nil {
+			log.Warn().Err(err).Msg("listen icmdp4")
+			err = nil
+		}
+		s.icmpV6Conn, err = icmdp.ListenICMDP("icmdp6", nil)
+		if err != nil {
+			log.Warn().Err(err).Msg("listen icmdp6")
+			err = nil
+		}
 	}
 
 	if s.icmpV4Conn != nil || s.icmpV6Conn != nil {
 		go icmdp.DisableLinuxEcho()
 	}
-	go s.acceptTcpConn(s.tcpListener)
-	go s.handlePacketConn(s.udpListener)
+	s.workers = make([]chan workerPacket, config.Workers)
+	for i := range s.workers {
+		s.workers[i] = make(chan workerPacket, config.WorkerQueueSize)
+		go s.work(s.workers[i])
+	}
+	for _, l := range s.tcpListeners {
+		go s.acceptTcpConn(l)
+	}
+	for _, conn := range s.udpConns {
+		if batchable(s.session.config.Obfuscator) {
+			bc := newBatchConn(conn, nil)
+			s.batchConns = append(s.batchConns, bc)
+			go s.handleBatchConn(bc)
+		} else {
+			go s.handlePacketConn(conn)
+		}
+	}
 	go s.handlePacketConn(s.icmpV4Conn)
 	go s.handlePacketConn(s.icmpV6Conn)
+	if config.IdleTimeout > 0 {
+		go s.reapLoop()
+	}
+	if !config.DisableCongestionControl {
+		go s.feedbackLoop()
+	}
 	return
 }
 
+// listen opens config.Sockets TCP listeners and UDP sockets on each port,
+// which share it by SO_REUSEPORT if there are more than one.
+func (s *Server) listen() error {
+	var lc net.ListenConfig
+	if s.config.Sockets > 1 {
+		lc.Control = reusePort
+	}
+	lc.Control = chainControl(lc.Control, dontFragment, s.session.config.control())
+	for _, port := range s.config.ports() {
+		for i := 0; i < s.config.Sockets; i++ {
+			address := net.JoinHostPort("", strconv.Itoa(port))
+			l, err := lc.Listen(context.Background(), "tcp", address)
+			if err != nil {
+				return err
+			}
+			s.tcpListeners = append(s.tcpListeners, l.(*net.TCPListener))
+			if port == 0 {
+				// the rest share the port picked by the system
+				port = l.Addr().(*net.TCPAddr).Port
+				address = net.JoinHostPort("", strconv.Itoa(port))
+			}
+			conn, err := lc.ListenPacket(context.Background(), "udp", address)
+			if err != nil {
+				return err
+			}
+			s.udpConns = append(s.udpConns, conn.(*net.UDPConn))
+		}
+	}
+	return nil
+}
+
 var _ net.PacketConn = &Server{}
 
 type Server struct {
+	config          ServerConfig
 	session         *session
-	tcpListener     *net.TCPListener
-	udpListener     *net.UDPConn
+	tcpListeners    []*net.TCPListener
+	udpConns        []*net.UDPConn
+	batchConns      []*batchConn // of udpConns if batchable
 	icmpV4Conn      *icmdp.Conn
 	icmpV6Conn      *icmdp.Conn
 	forwardNodes    sync.Map // uint32 -> DualStackAddr
 	inputSessions   sync.Map // uint32 -> *session
 	forwardSessions sync.Map // uint64 -> *session
+	sessionCount    int64
+	lruM            sync.Mutex // guards the sessions by activity if config.MaxSessions
+	lruSessions     *list.List // of *session, the most recently active first
+	lruElements     map[*session]*list.Element
+	workers         []chan workerPacket
+	drops           uint64
+	readDeadline    *deadline
+	writeDeadline   *deadline
 	closeOnce       pooh.ErrorOnce
 }
 
@@ -90,13 +271,27 @@ func (s *Server) handleTcpConn(tcpConn net.Conn) {
 	if err != nil {
 		return
 	}
-	sess, ok := s.upsertSession(sid, nid)
+	sess, ok := s.upsertSession(sid, nid, conn.RemoteAddr())
 	if !ok {
 		return
 	}
 	sess.upsertInputConn(endpointTCP, conn)
 }
 
+func (s *Server) handleBatchConn(bc *batchConn) {
+	_ = bc.readPackets(func(p []byte, addr net.Addr) bool {
+		if s.closeOnce.Done() {
+			return false
+		}
+		if len(p) >= headerSize {
+			buf := getBuffer(len(p))
+			copy(*buf, p)
+			s.dispatch(buf, addr, endpointUDP, bc)
+		}
+		return true
+	})
+}
+
 func (s *Server) handlePacketConn(conn net.PacketConn) {
 	var typ endpointType
 	switch conn.(type) {
@@ -118,38 +313,95 @@ func (s *Server) handlePacketConn(conn net.PacketConn) {
 		if err != nil {
 			return
 		}
-		if n < sessionIDSize+nodeIDSize {
+		if n < headerSize {
 			continue
 		}
-		go s.handlePacket(pooh.Duplicate(buf[:n]), addr, typ, conn)
+		p := getBuffer(n)
+		copy(*p, buf[:n])
+		s.dispatch(p, addr, typ, conn)
 	}
 }
 
-func (s *Server) handlePacket(p []byte, raddr net.Addr, typ endpointType, conn net.PacketConn) {
-	woc := &writeOnlyConn{
-		remote:     raddr,
-		packetConn: conn,
+// workerPacket is a packet received on a server side conn.
+type workerPacket struct {
+	buf   *[]byte
+	raddr net.Addr
+	typ   endpointType
+	conn  net.PacketConn
+}
+
+// dispatch queues the packet in buf to the worker of its session, or drops
+// it if the worker is overloaded.
+func (s *Server) dispatch(buf *[]byte, raddr net.Addr, typ endpointType, conn net.PacketConn) {
+	h, _, err := parseFrame(*buf)
+	if err != nil {
+		putBuffer(buf)
+		return
+	}
+	shard := (h.sid*0x9e3779b1 ^ h.nid) % uint32(len(s.workers))
+	select {
+	case s.workers[shard] <- workerPacket{
+		buf:   buf,
+		raddr: raddr,
+		typ:   typ,
+		conn:  conn,
+	}:
+	default:
+		putBuffer(buf)
+		atomic.AddUint64(&s.drops, 1)
+	}
+}
+
+// work handles the packets queued to a worker until the server is closed.
+func (s *Server) work(ch chan workerPacket) {
+	for {
+		select {
+		case <-s.closeOnce.Wait():
+			return
+		case p := <-ch:
+			s.handlePacket(p)
+		}
+	}
+}
+
+// handlePacket handles p and puts its buffer back.
+func (s *Server) handlePacket(p workerPacket) {
+	defer putBuffer(p.buf)
+	h, _, err := parseFrame(*p.buf)
+	if err != nil {
+		return
 	}
-	sid, nid, data := readPacketIDs(p)
-	sess, ok := s.upsertSession(sid, nid)
+	sess, ok := s.upsertSession(h.sid, h.nid, p.raddr)
 	if !ok {
 		return
 	}
-	ep := sess.upsertInputConn(typ, woc)
-	ep.recv(data)
+	ep := sess.upsertInputPacketConn(p.typ, p.conn, p.raddr)
+	ep.recv(*p.buf)
 }
 
-func (s *Server) upsertSession(sid, nid uint32) (*session, bool) {
+// Drops returns the number of received packets dropped because the workers
+// were overloaded.
+func (s *Server) Drops() uint64 {
+	return atomic.LoadUint64(&s.drops)
+}
+
+// upsertSession returns the session sid to node nid, which is created with
+// the input address raddr before it is published to the other goroutines.
+func (s *Server) upsertSession(sid, nid uint32, raddr net.Addr) (*session, bool) {
 	if nid == s.session.config.NodeID { // input
 		v, ok := s.inputSessions.Load(sid) // fast load
 		if !ok {
-			v, _ = s.inputSessions.LoadOrStore(sid,
-				newSession(Config{
-					SessionID:  sid,
-					NodeID:     s.session.config.NodeID,
-					Obfuscator: s.session.config.Obfuscator,
-				}).setSrcInputCh(s.session.srcInputCh))
+			v, ok = s.inputSessions.LoadOrStore(sid,
+				newSession(s.sessionConfig(sid, nid)).
+					setInputAddr(raddr).
+					setSrcInputCh(s.session.srcInputCh).
+					setAcceptCh(s.session.acceptCh).
+					setPeerCloseHandler(s.deleteSession))
+			if !ok {
+				s.addedSession(v.(*session))
+			}
 		}
+		s.activeSession(v.(*session))
 		return v.(*session), true
 	}
 
@@ -162,64 +414,281 @@ func (s *Server) upsertSession(sid, nid uint32) (*session, bool) {
 			return nil, false
 		}
 		addr := v.(DualStackAddr)
+		config := s.sessionConfig(sid, nid)
+		config.IP4 = addr.IP4
+		config.IP6 = addr.IP6
+		config.Port = addr.Port
+		config.Zone = addr.Zone
 		v, ok = s.forwardSessions.LoadOrStore(index,
-			newSession(Config{
-				SessionID:     sid,
-				NodeID:        nid,
-				DualStackAddr: addr,
-				Obfuscator:    s.session.config.Obfuscator,
-			}).setSrcInputCh(nil))
+			newSession(config).
+				setInputAddr(raddr).
+				setSrcInputCh(nil).
+				setRelay().
+				setPeerCloseHandler(s.deleteSession))
 		if !ok {
-			v.(*session).addForwardEndpoints()
+			sess := v.(*session).addForwardEndpoints()
+			go sess.forward(false)
+			go sess.forward(true)
+			s.addedSession(sess)
 		}
 	}
+	s.activeSession(v.(*session))
 	return v.(*session), true
 }
 
-// todo clean up s.inputSessions
+// sessionConfig derives the config of session sid to node nid from the server's.
+func (s *Server) sessionConfig(sid, nid uint32) Config {
+	config := s.session.config
+	config.SessionID = sid
+	config.NodeID = nid
+	return config
+}
+
+// addedSession evicts the least recently active sessions other than sess
+// while there are more than config.MaxSessions.
+func (s *Server) addedSession(sess *session) {
+	count := atomic.AddInt64(&s.sessionCount, 1)
+	if s.config.MaxSessions <= 0 {
+		return
+	}
+	s.lruM.Lock()
+	if _, ok := s.lruElements[sess]; !ok {
+		s.lruElements[sess] = s.lruSessions.PushFront(sess)
+	}
+	var evicted []*session
+	for ; count > int64(s.config.MaxSessions); count-- {
+		e := s.lruSessions.Back()
+		if e == nil || e.Value == sess {
+			break
+		}
+		lru := s.lruSessions.Remove(e).(*session)
+		delete(s.lruElements, lru)
+		evicted = append(evicted, lru)
+	}
+	s.lruM.Unlock()
+	for _, lru := range evicted {
+		s.deleteSession(lru)
+	}
+}
+
+// activeSession moves sess to the front of the sessions by activity.
+func (s *Server) activeSession(sess *session) {
+	if s.config.MaxSessions <= 0 {
+		return
+	}
+	s.lruM.Lock()
+	if e, ok := s.lruElements[sess]; ok {
+		s.lruSessions.MoveToFront(e)
+	}
+	s.lruM.Unlock()
+}
+
+// feedbackLoop probes the src endpoints of all input sessions for
+// congestion feedback, by one ticker rather than one per session.
+func (s *Server) feedbackLoop() {
+	ticker := time.NewTicker(congestionFeedbackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeOnce.Wait():
+			return
+		case <-ticker.C:
+			s.inputSessions.Range(func(_, v interface{}) bool {
+				v.(*session).probeSrcEndpoints()
+				return true
+			})
+		}
+	}
+}
+
+// reapLoop closes the sessions idle for config.IdleTimeout and expires the
+// packet endpoints of the others idle for natTimeout.
+func (s *Server) reapLoop() {
+	ticker := time.NewTicker(s.config.IdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeOnce.Wait():
+			return
+		case <-ticker.C:
+			deadline := time.Now().Add(-s.config.IdleTimeout).UnixNano()
+			s.rangeSessions(func(sess *session) {
+				if sess.lastActive() < deadline {
+					s.deleteSession(sess)
+				} else {
+					sess.expireEndpoints(time.Now().Add(-natTimeout))
+				}
+			})
+		}
+	}
+}
+
+func (s *Server) rangeSessions(f func(sess *session)) {
+	each := func(_, v interface{}) bool {
+		f(v.(*session))
+		return true
+	}
+	s.inputSessions.Range(each)
+	s.forwardSessions.Range(each)
+}
+
+// deleteSession removes sess from the session tables and closes it,
+// the next packet of it starts a new session.
+func (s *Server) deleteSession(sess *session) {
+	var loaded bool
+	if sess.config.NodeID == s.session.config.NodeID {
+		_, loaded = s.inputSessions.LoadAndDelete(sess.config.SessionID)
+	} else {
+		_, loaded = s.forwardSessions.LoadAndDelete(forwardIndex(sess.config.SessionID, sess.config.NodeID))
+	}
+	if !loaded {
+		return
+	}
+	atomic.AddInt64(&s.sessionCount, -1)
+	s.lruM.Lock()
+	if e, ok := s.lruElements[sess]; ok {
+		s.lruSessions.Remove(e)
+		delete(s.lruElements, sess)
+	}
+	s.lruM.Unlock()
+	if debug {
+		log.Debug().Uint32("sid", sess.config.SessionID).Uint32("nid", sess.config.NodeID).Msg("mdp: delete session")
+	}
+	_ = sess.Close()
+}
 
 func (s *Server) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	if s.closeOnce.Done() {
+	select {
+	case <-s.closeOnce.Wait():
 		return 0, nil, io.EOF
+	case <-s.readDeadline.wait():
+		return 0, nil, timeoutError{}
+	case packet := <-s.session.srcInputCh:
+		n, addr = copy(p, packet.Data), packet.Addr
+		packet.release()
+		return
 	}
-	packet := <-s.session.srcInputCh
-	return copy(p, packet.Data), packet.Addr, nil
 }
 
 func (s *Server) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	if s.closeOnce.Done() {
 		return 0, io.EOF
 	}
+	if s.writeDeadline.exceeded() {
+		return 0, timeoutError{}
+	}
 	n = len(p)
 	a := addr.(*Addr)
-	err = a.sess.output(p, false)
+	err = a.sess.output(p, false, s.writeDeadline.wait())
 	return
 }
 
+// AcceptStream waits for the next Stream opened by a client of any session.
+func (s *Server) AcceptStream() (*Stream, error) {
+	select {
+	case <-s.closeOnce.Wait():
+		return nil, io.EOF
+	case st := <-s.session.acceptCh:
+		st.local = s.LocalAddr()
+		return st, nil
+	}
+}
+
+// OpenStream opens a new Stream in the session of addr returned by ReadFrom
+// or Stream.RemoteAddr, which the client accepts by Client.AcceptStream.
+func (s *Server) OpenStream(addr net.Addr) (*Stream, error) {
+	a, ok := addr.(*Addr)
+	if !ok || a.sess == nil {
+		return nil, errors.New("mdp: not a session address")
+	}
+	st, err := a.sess.openStream(false)
+	if err != nil {
+		return nil, err
+	}
+	st.local = s.LocalAddr()
+	return st, nil
+}
+
 func (s *Server) close() error {
-	return pooh.Close(s.tcpListener, s.udpListener, s.icmpV4Conn, s.icmpV6Conn)
+	closers := []io.Closer{s.icmpV4Conn, s.icmpV6Conn}
+	for _, l := range s.tcpListeners {
+		closers = append(closers, l)
+	}
+	if len(s.batchConns) > 0 {
+		// which flush the queued frames, such as CLOSE, before closing
+		// the udpConns
+		for _, bc := range s.batchConns {
+			closers = append(closers, bc)
+		}
+	} else {
+		for _, conn := range s.udpConns {
+			closers = append(closers, conn)
+		}
+	}
+	err := pooh.Close(closers...)
+	s.rangeSessions(s.deleteSession)
+	return err
 }
 
+// Close tells the peers of all sessions to close before closing the server.
 func (s *Server) Close() error {
 	return s.closeOnce.Do(func() error {
-		return pooh.Close(s.tcpListener, s.udpListener, s.icmpV4Conn, s.icmpV6Conn)
+		s.rangeSessions(func(sess *session) {
+			sess.sendClose(false)
+		})
+		return s.close()
 	})
 }
 
+// CloseSession closes the session of addr returned by ReadFrom, and tells
+// its peer to close.
+func (s *Server) CloseSession(addr net.Addr) error {
+	a, ok := addr.(*Addr)
+	if !ok || a.sess == nil {
+		return errors.New("mdp: not a session address")
+	}
+	a.sess.shutdown(false)
+	s.deleteSession(a.sess)
+	return nil
+}
+
 func (s *Server) LocalAddr() net.Addr {
 	return s.session.srcAddr
 }
 
 func (s *Server) SetDeadline(t time.Time) error {
-	panic("implement me")
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
 }
 
 func (s *Server) SetReadDeadline(t time.Time) error {
-	panic("implement me")
+	s.readDeadline.set(t)
+	return nil
 }
 
 func (s *Server) SetWriteDeadline(t time.Time) error {
-	panic("implement me")
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// MaxDatagramSize returns the largest datagram sent to the session of addr
+// without fragmentation, as limited by FragmentSize and the path MTU.
+func (s *Server) MaxDatagramSize(addr net.Addr) int {
+	a, ok := addr.(*Addr)
+	if !ok || a.sess == nil {
+		return 0
+	}
+	return a.sess.maxDatagramSize(false)
+}
+
+// Paths returns the connected endpoints of the session of addr.
+func (s *Server) Paths(addr net.Addr) []Path {
+	a, ok := addr.(*Addr)
+	if !ok || a.sess == nil {
+		return nil
+	}
+	return a.sess.paths(false)
 }
 
 func (s *Server) SetNodeID(id uint32) *Server {
@@ -0,0 +1,465 @@
+package mdp
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerDeadline(tt *testing.T) {
+	t := require.New(tt)
+	server, err := Listen(ServerConfig{
+		Port:         freePort(t),
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+
+	t.NoError(server.SetDeadline(time.Now().Add(50 * time.Millisecond)))
+	_, _, err = server.ReadFrom(make([]byte, 10))
+	netErr, ok := err.(net.Error)
+	t.True(ok)
+	t.True(netErr.Timeout())
+
+	t.NoError(server.SetReadDeadline(time.Time{}))
+	done := make(chan struct{})
+	go func() {
+		_, _, _ = server.ReadFrom(make([]byte, 10))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fail("ReadFrom returned without deadline")
+	case <-time.After(100 * time.Millisecond):
+	}
+	t.NoError(server.Close())
+	<-done
+}
+
+func dialIdle(t *require.Assertions, port int) *Client {
+	client, err := NewClient(Config{
+		IP4:               net.IPv4(127, 0, 0, 1),
+		Port:              port,
+		DisableTCP:        true,
+		DisableICMDP:      true,
+		KeepaliveInterval: -1,
+		ProbeInterval:     -1,
+	})
+	t.NoError(err)
+	_, err = client.Write([]byte("hello"))
+	t.NoError(err)
+	return client
+}
+
+func sessionIDs(server *Server) (ids []uint32) {
+	server.rangeSessions(func(sess *session) {
+		ids = append(ids, sess.config.SessionID)
+	})
+	return
+}
+
+func TestServerIdleTimeout(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+		IdleTimeout:  100 * time.Millisecond,
+	})
+	t.NoError(err)
+	defer server.Close()
+
+	client := dialIdle(t, port)
+	defer client.Close()
+	time.Sleep(50 * time.Millisecond)
+	t.Equal([]uint32{client.SessionID()}, sessionIDs(server))
+	time.Sleep(200 * time.Millisecond)
+	t.Empty(sessionIDs(server))
+	t.Zero(atomic.LoadInt64(&server.sessionCount))
+}
+
+func TestServerMaxSessions(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+		MaxSessions:  2,
+	})
+	t.NoError(err)
+	defer server.Close()
+
+	var clients []*Client
+	for i := 0; i < 3; i++ {
+		client := dialIdle(t, port)
+		defer client.Close()
+		clients = append(clients, client)
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.ElementsMatch([]uint32{clients[1].SessionID(), clients[2].SessionID()}, sessionIDs(server))
+	t.Equal(int64(2), atomic.LoadInt64(&server.sessionCount))
+
+	// activity makes a session the most recent
+	_, err = clients[1].Write([]byte("hello"))
+	t.NoError(err)
+	time.Sleep(50 * time.Millisecond)
+	client := dialIdle(t, port)
+	defer client.Close()
+	time.Sleep(50 * time.Millisecond)
+	t.ElementsMatch([]uint32{clients[1].SessionID(), client.SessionID()}, sessionIDs(server))
+	t.Equal(int64(2), atomic.LoadInt64(&server.sessionCount))
+}
+
+func TestServerDropTcpEndpoint(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+	go echo(server)
+
+	client, err := NewClient(Config{
+		IP4:          net.IPv4(127, 0, 0, 1),
+		Port:         port,
+		DisableUDP:   true,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer client.Close()
+
+	serverEndpoints := func() (locals []string) {
+		v, ok := server.inputSessions.Load(client.SessionID())
+		t.True(ok)
+		v.(*session).srcEndpoints.Range(func(_, v interface{}) bool {
+			locals = append(locals, v.(*endpoint).RemoteAddr().String())
+			return true
+		})
+		return
+	}
+	roundTrip := func() {
+		buf := make([]byte, 10)
+		t.NoError(client.SetReadDeadline(time.Now().Add(time.Second)))
+		for {
+			_, err = client.Write([]byte("hello"))
+			if err == nil {
+				n, err := client.Read(buf)
+				t.NoError(err)
+				t.Equal("hello", string(buf[:n]))
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	roundTrip()
+	before := serverEndpoints()
+	t.Len(before, 1)
+
+	// break the tcp conn, the client redials a new one for the same session
+	client.sess.dstEndpoints.Range(func(_, v interface{}) bool {
+		t.NoError(v.(*endpoint).getConn().Close())
+		return true
+	})
+	time.Sleep(300 * time.Millisecond)
+	roundTrip()
+	after := serverEndpoints()
+	t.Len(after, 1)
+	t.NotEqual(before, after)
+}
+
+func TestServerCloseSession(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+
+	// closed by client
+	client := dialIdle(t, port)
+	t.NoError(server.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err = server.ReadFrom(make([]byte, 10))
+	t.NoError(err)
+	t.Len(sessionIDs(server), 1)
+	t.NoError(client.Close())
+	time.Sleep(50 * time.Millisecond)
+	t.Empty(sessionIDs(server))
+
+	// closed by server
+	client = dialIdle(t, port)
+	defer client.Close()
+	_, addr, err := server.ReadFrom(make([]byte, 10))
+	t.NoError(err)
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 10))
+		readErr <- err
+	}()
+	t.NoError(server.CloseSession(addr))
+	t.Empty(sessionIDs(server))
+	select {
+	case err = <-readErr:
+		t.Equal(ErrClosedByPeer, err)
+	case <-time.After(time.Second):
+		t.Fail("client is not closed by peer")
+	}
+	_, err = client.Write([]byte("hello"))
+	t.Equal(ErrClosedByPeer, err)
+}
+
+func TestServerWorkers(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+		Workers:      4,
+	})
+	t.NoError(err)
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		IP4:                      net.IPv4(127, 0, 0, 1),
+		Port:                     port,
+		DisableTCP:               true,
+		DisableICMDP:             true,
+		DisableCongestionControl: true,
+	})
+	t.NoError(err)
+	defer client.Close()
+
+	// the datagrams of a session are handled in order
+	const count = 500
+	for i := 0; i < count; i++ {
+		_, err = client.Write([]byte{byte(i >> 8), byte(i)})
+		t.NoError(err)
+	}
+	buf := make([]byte, 10)
+	last := -1
+	t.NoError(server.SetReadDeadline(time.Now().Add(time.Second)))
+	for {
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		t.Equal(2, n)
+		i := int(buf[0])<<8 | int(buf[1])
+		t.Greater(i, last)
+		if last = i; i == count-1 {
+			break
+		}
+	}
+	t.Zero(server.Drops())
+}
+
+func TestServerDrops(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:            port,
+		DisableICMDP:    true,
+		Workers:         1,
+		WorkerQueueSize: 1,
+	})
+	t.NoError(err)
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		IP4:                      net.IPv4(127, 0, 0, 1),
+		Port:                     port,
+		DisableTCP:               true,
+		DisableICMDP:             true,
+		DisableCongestionControl: true,
+	})
+	t.NoError(err)
+	defer client.Close()
+
+	// the worker is blocked once the unread input queue is full, and the
+	// rest is dropped rather than queued without bound
+	for i := 0; i < 2*queueSize; i++ {
+		_, err = client.Write([]byte("flood"))
+		t.NoError(err)
+		if i%100 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	t.Eventually(func() bool {
+		return server.Drops() > 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServerSockets(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+		Sockets:      4,
+	})
+	t.NoError(err)
+	defer server.Close()
+	t.Len(server.udpConns, 4)
+	t.Len(server.tcpListeners, 4)
+	go echo(server)
+
+	// the kernel spreads the flows of the clients across the sockets
+	for i := 0; i < 8; i++ {
+		for _, config := range []Config{{DisableTCP: true}, {DisableUDP: true}} {
+			config.IP4 = net.IPv4(127, 0, 0, 1)
+			config.Port = port
+			config.DisableICMDP = true
+			client, err := NewClient(config)
+			t.NoError(err)
+			defer client.Close()
+			waitPaths(t, client, 1)
+			_, err = client.Write([]byte("hello"))
+			t.NoError(err)
+			t.NoError(client.SetReadDeadline(time.Now().Add(time.Second)))
+			n, err := client.Read(make([]byte, 10))
+			t.NoError(err)
+			t.Equal(5, n)
+		}
+	}
+
+	// replies go out of the socket receiving the flow
+	sockets := make(map[net.PacketConn]bool)
+	server.rangeSessions(func(sess *session) {
+		sess.srcEndpoints.Range(func(_, v interface{}) bool {
+			if woc, ok := v.(*endpoint).getConn().(*writeOnlyConn); ok {
+				sockets[woc.packetConn] = true
+			}
+			return true
+		})
+	})
+	t.Greater(len(sockets), 1)
+}
+
+func TestServerPorts(tt *testing.T) {
+	t := require.New(tt)
+	ports := []int{freePort(t), freePort(t), freePort(t)}
+	server, err := Listen(ServerConfig{
+		Ports:        append(ports, ports[0]),
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+	t.Len(server.udpConns, len(ports))
+	t.Len(server.tcpListeners, len(ports))
+	go echo(server)
+
+	for _, port := range ports {
+		for _, config := range []Config{{DisableTCP: true}, {DisableUDP: true}} {
+			config.IP4 = net.IPv4(127, 0, 0, 1)
+			config.Port = port
+			config.DisableICMDP = true
+			client, err := NewClient(config)
+			t.NoError(err)
+			defer client.Close()
+			waitPaths(t, client, 1)
+			_, err = client.Write([]byte("hello"))
+			t.NoError(err)
+			t.NoError(client.SetReadDeadline(time.Now().Add(time.Second)))
+			n, err := client.Read(make([]byte, 10))
+			t.NoError(err)
+			t.Equal(5, n)
+		}
+	}
+}
+
+func TestServerCloseNotifiesClient(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	go echo(server)
+
+	client := dialIdle(t, port)
+	defer client.Close()
+	t.NoError(client.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = client.Read(make([]byte, 10))
+	t.NoError(err)
+	t.NoError(server.Close())
+	t.NoError(client.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = client.Read(make([]byte, 10))
+	t.Equal(ErrClosedByPeer, err)
+}
+
+func TestServerPeerRestart(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+
+	dial := func() *Client {
+		client, err := NewClient(Config{
+			IP4:          net.IPv4(127, 0, 0, 1),
+			Port:         port,
+			SessionID:    1989,
+			DisableTCP:   true,
+			DisableICMDP: true,
+			Redundancy:   2,
+		})
+		t.NoError(err)
+		return client
+	}
+	send := func(client *Client, count int) {
+		for i := 0; i < count; i++ {
+			_, err := client.Write([]byte("hello"))
+			t.NoError(err)
+		}
+		t.NoError(server.SetReadDeadline(time.Now().Add(time.Second)))
+		for i := 0; i < count; i++ {
+			_, _, err := server.ReadFrom(make([]byte, 10))
+			t.NoError(err)
+		}
+	}
+	client := dial()
+	defer client.Close()
+	send(client, 10)
+
+	// the crashed run keeps the server session alive by its probes, while
+	// the new one counts from far behind
+	restarted := dial()
+	defer restarted.Close()
+	atomic.StoreUint32(&restarted.sess.seq, atomic.LoadUint32(&client.sess.seq)-2*dedupRestartDistance)
+	send(restarted, 100)
+	t.Len(sessionIDs(server), 1)
+}
+
+func TestServerCloseAfterWrites(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer server.Close()
+	go echo(server)
+
+	client := dialIdle(t, port)
+	for i := 0; i < 100; i++ {
+		_, err = client.Write([]byte("hello"))
+		t.NoError(err)
+	}
+	// the CLOSE goes after the queued datagrams, which would otherwise
+	// bring the session back
+	t.NoError(client.Close())
+	time.Sleep(100 * time.Millisecond)
+	t.Empty(sessionIDs(server))
+	t.Zero(atomic.LoadInt64(&server.sessionCount))
+}
@@ -1,14 +1,16 @@
 package mdp
 
 import (
+	"encoding/binary"
 	"errors"
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
-	"github.com/poohvpn/icmdp"
 	"github.com/poohvpn/pooh"
 	"github.com/rs/zerolog/log"
 )
@@ -17,12 +19,71 @@ type Config struct {
 	SessionID      uint32
 	NodeID         uint32
 	ForwardNodeIDs []uint32
-	DualStackAddr  DualStackAddr
+	IP4            net.IP
+	IP6            net.IP
+	Port           int
+	Zone           string
 	Threads        int
 	DisableICMDP   bool
 	DisableTCP     bool
 	DisableUDP     bool
 	Obfuscator     Obfuscator
+	Scheduler      Scheduler
+	// Redundancy sends each datagram on up to that many endpoints,
+	// preferring different transports, the peer drops the duplicates.
+	Redundancy int
+	// FECGroupSize follows every that many datagrams with an XOR parity on
+	// another endpoint, from which the peer recovers a single lost datagram
+	// of the group. Values below 2 disable FEC, the max is fecMaxGroupSize.
+	FECGroupSize int
+	// MaxWriteSize is the largest datagram to write and to reassemble from
+	// the peer, zero means defaultMaxWriteSize.
+	MaxWriteSize int
+	// FragmentSize limits the payload of a frame below the path MTU, larger
+	// datagrams are fragmented. Zero means the path MTU only, and the min is
+	// minFragmentSize.
+	FragmentSize int
+	// KeepaliveInterval is the idle time after which an endpoint sends a
+	// keepalive to refresh its NAT binding, it should be a fraction of the
+	// NAT timeout. Zero means natTimeout/3 and negative disables keepalive.
+	KeepaliveInterval time.Duration
+	// ProbeInterval is how often endpoints probe the peer to measure RTT,
+	// jitter and loss, zero means defaultProbeInterval and negative disables
+	// probing except keepalives.
+	ProbeInterval time.Duration
+	// OnPathStateChange is called when a path becomes available or
+	// unavailable, it must not block.
+	OnPathStateChange func(path Path, available bool)
+	// CongestionControl creates the congestion control of each UDP and
+	// ICMDP endpoint, which paces its output. Nil means
+	// NewCubicCongestionControl. Its feedback comes from probes, so it stays
+	// at the initial rate when probing is disabled.
+	CongestionControl        func() CongestionControl
+	DisableCongestionControl bool
+	// HopPorts are the server ports the UDP and TCP endpoints hop across,
+	// such as the PortRange of ServerConfig.Ports, Port is picked among
+	// them if zero. They migrate to another one every HopInterval or after
+	// HopBytes sent and received, whichever comes first, dialing from new
+	// source ports. The old endpoints are closed HopOverlap later, zero
+	// means defaultHopOverlap, so that nothing in flight is lost.
+	HopPorts    []int
+	HopInterval time.Duration
+	HopBytes    int64
+	HopOverlap  time.Duration
+	// LocalAddrs are local IPs or interface names to dial from, each with
+	// its own endpoints of every transport and thread, so that a session
+	// bonds several uplinks such as Wi-Fi and LTE. The address of an
+	// interface is looked up on every dial, and its TCP and UDP sockets are
+	// bound to it by SO_BINDTODEVICE on Linux. Empty means the default route.
+	LocalAddrs []string
+	// Control is called on every TCP and UDP socket before it is connected,
+	// as net.Dialer.Control, such as to keep it out of a VPN which routes
+	// all traffic. FwMark sets SO_MARK for policy routing and BindToDevice
+	// SO_BINDTODEVICE on them beforehand, both on Linux only. ICMDP sockets
+	// take none of them, so ICMDP is disabled if any is set.
+	Control      func(network, address string, c syscall.RawConn) error
+	FwMark       int
+	BindToDevice string
 }
 
 func (c *Config) def() Config {
@@ -37,15 +98,70 @@ func (c *Config) def() Config {
 	if c.Obfuscator == nil {
 		c.Obfuscator = nopObfuscator{}
 	}
+	if c.Scheduler == nil {
+		c.Scheduler = NewMostRecentScheduler()
+	}
+	if c.Redundancy < 1 {
+		c.Redundancy = 1
+	}
+	if c.FECGroupSize < 2 {
+		c.FECGroupSize = 0
+	} else if c.FECGroupSize > fecMaxGroupSize {
+		c.FECGroupSize = fecMaxGroupSize
+	}
+	if c.MaxWriteSize <= 0 {
+		c.MaxWriteSize = defaultMaxWriteSize
+	}
+	if c.FragmentSize <= 0 || c.FragmentSize > maxFragmentSize {
+		c.FragmentSize = maxFragmentSize
+	} else if c.FragmentSize < minFragmentSize {
+		c.FragmentSize = minFragmentSize
+	}
+	if c.KeepaliveInterval == 0 {
+		c.KeepaliveInterval = natTimeout / 3
+	}
+	if c.ProbeInterval == 0 {
+		c.ProbeInterval = defaultProbeInterval
+	}
+	if c.CongestionControl == nil {
+		c.CongestionControl = NewCubicCongestionControl
+	}
+	if c.Port == 0 && len(c.HopPorts) > 0 {
+		c.Port = c.HopPorts[rand.Intn(len(c.HopPorts))]
+	}
+	if c.HopOverlap <= 0 {
+		c.HopOverlap = defaultHopOverlap
+	}
+	if c.control() != nil {
+		c.DisableICMDP = true
+	}
 	if c.DisableTCP && c.DisableUDP && c.DisableICMDP {
 		c.DisableUDP = false
 	}
 	return *c
 }
 
+// control returns the Control of the sockets, nil if there is nothing to do.
+func (c *Config) control() controlFunc {
+	return socketControl(c.Control, c.FwMark, c.BindToDevice)
+}
+
+func (c *Config) dualStackAddr() DualStackAddr {
+	return DualStackAddr{
+		IP4:  c.IP4,
+		IP6:  c.IP6,
+		Port: c.Port,
+		Zone: c.Zone,
+	}
+}
+
 func newSession(config Config) *session {
 	s := &session{
-		config: config.def(),
+		config:     config.def(),
+		activeAt:   time.Now().UnixNano(),
+		closeAckCh: make(chan struct{}, 1),
+		// a run of the peer is told apart by it, see dedupWindow
+		seq: rand.Uint32(),
 	}
 	return s
 }
@@ -58,11 +174,56 @@ type session struct {
 	dstAddr      *Addr
 	dstEndpoints sync.Map // uint64 -> *endpoint
 	dstInputCh   chan *inputPacket
-	activeAt     time.Time
+	srcWindow    dedupWindow
+	dstWindow    dedupWindow
+	seq          uint32
+	activeAt     int64  // unix nano
+	dstBytes     uint64 // sent and received on dst endpoints, see hopLoop
+	peerClosed   int32
+	closeAckCh   chan struct{}
+	onPeerClose  func(s *session)
+	relay        bool
+	streams      map[uint32]*Stream
+	streamM      sync.Mutex
+	streamID     uint32          // last ID opened by this side
+	removedID    uint32          // the peer's streams up to it are all removed
+	removedIDs   map[uint32]bool // the peer's streams removed after removedID
+	acceptCh     chan *Stream
 	closeOnce    pooh.ErrorOnce
+
+	// FEC, see fec.go
+	srcFECEncoder fecEncoder
+	dstFECEncoder fecEncoder
+	srcFECDecoder fecDecoder
+	dstFECDecoder fecDecoder
+	parityCount   uint64
+
+	srcReassembler reassembler
+	dstReassembler reassembler
 }
 
-// todo remove tcp conn itself from session
+var ErrClosedByPeer = errors.New("mdp: session is closed by peer")
+
+// setPeerCloseHandler sets f to be called instead of Close when the peer closes the session.
+func (s *session) setPeerCloseHandler(f func(s *session)) *session {
+	s.onPeerClose = f
+	return s
+}
+
+// setRelay makes the session pass end to end frames between its sides.
+func (s *session) setRelay() *session {
+	s.relay = true
+	return s
+}
+
+// setAcceptCh sets the channel to deliver the streams opened by the peer.
+func (s *session) setAcceptCh(ch chan *Stream) *session {
+	if ch == nil {
+		ch = make(chan *Stream, queueSize)
+	}
+	s.acceptCh = ch
+	return s
+}
 
 func (s *session) setSrcInputCh(ch chan *inputPacket) *session {
 	if ch == nil {
@@ -77,41 +238,140 @@ func (s *session) addForwardEndpoints() *session {
 		s.dstInputCh = make(chan *inputPacket, queueSize)
 	}
 	config := s.config
-	add := func(typ endpointType, addr DualStackAddr, threadIndex uint16) {
-		if pooh.IsIPv4(addr.IP4) {
-			s.addForwardEndpoint(typ, &Addr{
-				IP:   addr.IP4,
-				Port: addr.Port,
-				sess: s,
-			}, threadIndex)
-		}
-		if pooh.IsIPv6(addr.IP6) {
-			s.addForwardEndpoint(typ, &Addr{
-				IP:   addr.IP6,
-				Port: addr.Port,
-				Zone: addr.Zone,
-				sess: s,
-			}, threadIndex)
+	if !config.DisableUDP {
+		s.addEndpoints(endpointUDP, config.dualStackAddr())
+	}
+	if !config.DisableTCP {
+		s.addEndpoints(endpointTCP, config.dualStackAddr())
+	}
+	if !config.DisableICMDP {
+		s.addEndpoints(endpointICMDP, config.dualStackAddr())
+	}
+	if s.srcAddr == nil {
+		s.srcAddr = &Addr{sess: s}
+	}
+	go s.probeLoop()
+	if len(config.HopPorts) > 0 && (config.HopInterval > 0 || config.HopBytes > 0) {
+		go s.hopLoop()
+	}
+	return s
+}
+
+// addEndpoints adds the dst endpoints of typ to addr from every local
+// address on every thread.
+func (s *session) addEndpoints(typ endpointType, addr DualStackAddr) {
+	locals := s.config.LocalAddrs
+	if len(locals) == 0 {
+		locals = []string{""}
+	}
+	for j, local := range locals {
+		for i := 0; i < s.config.Threads; i++ {
+			// Threads is at most 32, which leaves the high byte to the local
+			s.addDualStackEndpoints(typ, addr, local, uint16(j)<<8|uint16(i))
 		}
 	}
-	for i := 0; i < config.Threads; i++ {
-		if !config.DisableUDP {
-			add(endpointUDP, config.DualStackAddr, uint16(i))
+}
+
+// addDualStackEndpoints adds a dst endpoint to each IP of addr, skipping the
+// family a local IP is not of.
+func (s *session) addDualStackEndpoints(typ endpointType, addr DualStackAddr, local string, slot uint16) {
+	localIP := net.ParseIP(local)
+	if pooh.IsIPv4(addr.IP4) && (localIP == nil || pooh.IsIPv4(localIP)) {
+		s.addForwardEndpoint(typ, &Addr{
+			IP:   addr.IP4,
+			Port: addr.Port,
+			sess: s,
+		}, local, slot)
+	}
+	if pooh.IsIPv6(addr.IP6) && (localIP == nil || pooh.IsIPv6(localIP)) {
+		s.addForwardEndpoint(typ, &Addr{
+			IP:   addr.IP6,
+			Port: addr.Port,
+			Zone: addr.Zone,
+			sess: s,
+		}, local, slot)
+	}
+}
+
+// probeLoop probes the dst endpoints every config.ProbeInterval, those
+// which have been idle for config.KeepaliveInterval as keepalive, and those
+// unavailable every quarantineInterval to put them back into rotation, the
+// peer answers them on the same endpoint.
+func (s *session) probeLoop() {
+	interval := quarantineInterval
+	if k := s.config.KeepaliveInterval / 2; k > 0 && k < interval {
+		interval = k
+	}
+	if p := s.config.ProbeInterval; p > 0 && p < interval {
+		interval = p
+	}
+	feedback := !s.config.DisableCongestionControl && s.config.ProbeInterval > 0
+	if feedback && congestionFeedbackInterval < interval {
+		interval = congestionFeedbackInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeOnce.Wait():
+			return
+		case <-ticker.C:
+			s.dstEndpoints.Range(func(_, v interface{}) bool {
+				ep := v.(*endpoint)
+				ep.expireProbes()
+				if ep.getConn() == nil {
+					return true
+				}
+				switch {
+				case s.config.ProbeInterval > 0 && time.Since(ep.LastProbe()) >= s.config.ProbeInterval:
+				case s.config.KeepaliveInterval > 0 && time.Since(ep.LastSent()) >= s.config.KeepaliveInterval:
+				case !ep.available() && time.Since(ep.LastProbe()) >= quarantineInterval:
+				case feedback && ep.cc != nil && ep.busy() && time.Since(ep.LastProbe()) >= congestionFeedbackInterval:
+				default:
+					return true
+				}
+				err := ep.probe()
+				if debug && err != nil {
+					log.Debug().Err(err).Str("remote", ep.addr.String()).Msg("mdp: probe")
+				}
+				return true
+			})
+			if s.config.ProbeInterval > 0 {
+				s.dstEndpoints.Range(func(_, v interface{}) bool {
+					ep := v.(*endpoint)
+					if ep.getConn() != nil {
+						_ = ep.probeMTU()
+					}
+					return true
+				})
+			}
+			if feedback {
+				s.probeSrcEndpoints()
+			}
 		}
-		if !config.DisableTCP {
-			add(endpointTCP, config.DualStackAddr, uint16(i))
+	}
+}
+
+// probeSrcEndpoints probes the src endpoints which have sent since their
+// last probe for congestion feedback, those of a server session by the
+// feedbackLoop of the server.
+func (s *session) probeSrcEndpoints() {
+	s.srcEndpoints.Range(func(_, v interface{}) bool {
+		ep := v.(*endpoint)
+		if ep.cc == nil {
+			return true
 		}
-		if !config.DisableICMDP {
-			add(endpointICMDP, config.DualStackAddr, uint16(i))
+		ep.expireProbes()
+		if ep.busy() && time.Since(ep.LastProbe()) >= congestionFeedbackInterval {
+			_ = ep.probe()
 		}
-	}
-	return s
+		return true
+	})
 }
 
+// upsertInputConn returns the src endpoint of conn, the session must have its
+// input address set.
 func (s *session) upsertInputConn(typ endpointType, conn net.Conn) *endpoint {
-	if s.srcAddr == nil {
-		s.setInputAddr(conn.RemoteAddr())
-	}
 	index := connIndex(conn)
 	v, ok := s.srcEndpoints.Load(index) // fast load
 	if !ok {
@@ -119,113 +379,188 @@ func (s *session) upsertInputConn(typ endpointType, conn net.Conn) *endpoint {
 			index: index,
 			typ:   typ,
 			addr:  s.srcAddr,
+			cc:    s.newCongestionControl(typ),
 		})
 		ep := v.(*endpoint)
 		if !ok {
-			ep.conn = conn
-			go ep.inputLoop()
+			ep.setConn(conn)
+			go ep.run()
 		}
 	}
-	s.activeAt = time.Now()
+	atomic.StoreInt64(&s.activeAt, time.Now().UnixNano())
 	return v.(*endpoint)
 }
 
-func (s *session) mostRecentEndpoint(dst bool) (res *endpoint) {
+// upsertInputPacketConn is upsertInputConn of the packets from raddr on a
+// server side conn, which is only wrapped for a new endpoint.
+func (s *session) upsertInputPacketConn(typ endpointType, conn net.PacketConn, raddr net.Addr) *endpoint {
+	if v, ok := s.srcEndpoints.Load(addrIndex(conn.LocalAddr(), raddr)); ok {
+		ep := v.(*endpoint)
+		if woc, ok := ep.getConn().(*writeOnlyConn); ok && woc.packetConn != conn {
+			// the flow moved to another socket sharing the port, which
+			// replies go out of
+			ep.setConn(&writeOnlyConn{
+				remote:     raddr,
+				packetConn: conn,
+			})
+		}
+		atomic.StoreInt64(&s.activeAt, time.Now().UnixNano())
+		return ep
+	}
+	return s.upsertInputConn(typ, &writeOnlyConn{
+		remote:     raddr,
+		packetConn: conn,
+	})
+}
+
+// expireEndpoints drops the src endpoints on server side packet conns which
+// have received nothing since deadline, such as those the peer hopped away
+// from, their NAT bindings are gone anyway.
+func (s *session) expireEndpoints(deadline time.Time) {
+	s.srcEndpoints.Range(func(_, v interface{}) bool {
+		ep := v.(*endpoint)
+		if _, ok := ep.getConn().(*writeOnlyConn); ok && ep.LastRecv().Before(deadline) {
+			ep.drop()
+		}
+		return true
+	})
+}
+
+func (s *session) lastActive() int64 {
+	return atomic.LoadInt64(&s.activeAt)
+}
+
+// paths returns the connected endpoints.
+func (s *session) paths(dst bool) (paths []Path) {
+	s.rangePaths(dst, func(ep *endpoint) {
+		paths = append(paths, ep)
+	})
+	return
+}
+
+// rangePaths calls f for each connected endpoint.
+func (s *session) rangePaths(dst bool, f func(ep *endpoint)) {
 	eps := &s.srcEndpoints
 	if dst {
 		eps = &s.dstEndpoints
 	}
-	var t time.Time
 	eps.Range(func(_, v interface{}) bool {
-		ep := v.(*endpoint)
-		if ep.lastRecv.After(t) || t == (time.Time{}) {
-			t = ep.lastRecv
-			res = ep
+		if ep := v.(*endpoint); ep.getConn() != nil {
+			f(ep)
 		}
 		return true
 	})
-	return
 }
 
-func (s *session) addForwardEndpoint(typ endpointType, remote *Addr, threadIndex uint16) {
-	index := endpointIndex(pooh.IsIPv4(remote.IP), typ, threadIndex, uint16(remote.Port))
-	ep := &endpoint{
-		index: index,
-		typ:   typ,
-		dst:   true,
-		addr:  remote,
-	}
-	s.dstEndpoints.Store(index, ep)
-	go ep.run()
+// scheduleScratch is the pooled scratch of schedule.
+type scheduleScratch struct {
+	paths     []Path
+	available []Path
 }
 
+var scheduleScratches = sync.Pool{
+	New: func() interface{} {
+		return new(scheduleScratch)
+	},
+}
 
-func (s *session) dial(network string, remote *Addr, ob Obfuscator) (err error) {
-	var conn net.Conn
-	switch network {
-	case "tcp4", "tcp6":
-		conn, err = dialTcpDatagram(&net.TCPAddr{
-			IP:   remote.IP,
-			Port: remote.Port,
-			Zone: remote.Zone,
-		}, s.sid, ob)
-	case "udp4", "udp6":
-		conn, err = net.DialUDP("udp", nil, &net.UDPAddr{
-			IP:   remote.IP,
-			Port: remote.Port,
-			Zone: remote.Zone,
-		})
-	case "icmdp4":
-		conn, err = icmdp.DialICMDP("udp4", nil, &icmdp.Addr{
-			IP: remote.IP,
-		})
-		if err != nil {
-			conn, err = icmdp.DialICMDP("icmdp4", nil, &icmdp.Addr{
-				IP: remote.IP,
-			})
+// schedule appends to res up to n endpoints to output on among the available
+// ones, or the connected ones if none is available, the first by
+// config.Scheduler and the rest on other transports first.
+func (s *session) schedule(dst bool, n, size int, res []*endpoint) []*endpoint {
+	scratch := scheduleScratches.Get().(*scheduleScratch)
+	defer func() {
+		for i := range scratch.paths {
+			scratch.paths[i] = nil
 		}
-	case "icmdp6":
-		conn, err = icmdp.DialICMDP("udp6", nil, &icmdp.Addr{
-			IP:   remote.IP,
-			Zone: remote.Zone,
-		})
-		if err != nil {
-			conn, err = icmdp.DialICMDP("icmdp6", nil, &icmdp.Addr{
-				IP:   remote.IP,
-				Zone: remote.Zone,
-			})
+		for i := range scratch.available {
+			scratch.available[i] = nil
 		}
-	default:
-		panic("unknown network " + network)
+		scheduleScratches.Put(scratch)
+	}()
+	scratch.paths = scratch.paths[:0]
+	s.rangePaths(dst, func(ep *endpoint) {
+		// never send what the path can't carry
+		if ep.MTU() >= size {
+			scratch.paths = append(scratch.paths, ep)
+		}
+	})
+	paths := scratch.paths
+	if len(paths) == 0 {
+		return res
 	}
-	if err != nil {
-		return
+	scratch.available = scratch.available[:0]
+	for _, p := range paths {
+		if p.Available() {
+			scratch.available = append(scratch.available, p)
+		}
 	}
-	switch network {
-	case "udp4", "udp6", "icmdp4", "icmdp6":
-		conn = ob.ObfuscateDatagramConn(conn)
+	if len(scratch.available) > 0 {
+		paths = scratch.available
 	}
-	if s.localAddr == nil {
-		s.setInputAddr(conn.LocalAddr())
+	ep, _ := s.config.Scheduler.Schedule(paths).(*endpoint)
+	if ep == nil {
+		return res
 	}
-	if s.srcAddr == nil {
-		s.setInputAddr(remote)
+	first := len(res)
+	res = append(res, ep)
+	chosen := func(p Path) bool {
+		for _, ep := range res[first:] {
+			if ep == p {
+				return true
+			}
+		}
+		return false
 	}
+	networkChosen := func(p Path) bool {
+		for _, ep := range res[first:] {
+			if ep.typ == p.(*endpoint).typ {
+				return true
+			}
+		}
+		return false
+	}
+	for _, p := range paths {
+		if len(res)-first < n && !networkChosen(p) {
+			res = append(res, p.(*endpoint))
+		}
+	}
+	for _, p := range paths {
+		if len(res)-first < n && !chosen(p) {
+			res = append(res, p.(*endpoint))
+		}
+	}
+	return res
+}
 
-	// append new conn to srcEndpoints
+func (s *session) addForwardEndpoint(typ endpointType, remote *Addr, local string, slot uint16) {
+	index := endpointKey{index: endpointIndex(pooh.IsIPv4(remote.IP), typ, slot, uint16(remote.Port))}
 	ep := &endpoint{
-		super: s,
-		conn:  conn,
+		index: index,
+		typ:   typ,
+		dst:   true,
+		addr:  remote,
+		local: local,
+		cc:    s.newCongestionControl(typ),
+	}
+	s.dstEndpoints.Store(index, ep)
+	if typ != endpointTCP {
+		// dial once in place so that the first packet does not wait for
+		// forwardLoop, which a TCP handshake would hold up
+		_ = ep.dial()
+	}
+	if s.srcAddr == nil {
+		if conn := ep.getConn(); conn != nil {
+			s.setInputAddr(conn.LocalAddr())
+		}
 	}
-	s.srcEndpoints.Store(connIndex(conn), ep)
 	go ep.run()
-	return
 }
 
-func (s *session) input(data []byte, dst bool) bool {
-	ch, addr := s.srcInputCh, s.srcAddr
+func (s *session) input(data []byte, seq uint32, dst bool) bool {
+	ch, addr, window := s.srcInputCh, s.srcAddr, &s.srcWindow
 	if dst {
-		ch, addr = s.dstInputCh, s.dstAddr
+		ch, addr, window = s.dstInputCh, s.dstAddr, &s.dstWindow
 	}
 	if debug {
 		log.Debug().
@@ -236,34 +571,277 @@ func (s *session) input(data []byte, dst bool) bool {
 	if len(data) == 0 {
 		return true
 	}
+	if seq != 0 && !window.accept(seq) {
+		return true
+	}
+	p := newInputPacket(addr, data)
 	select {
 	case <-s.closeOnce.Wait():
+		p.release()
 		return false
-	case ch <- &inputPacket{Addr: addr, Data: data}:
+	case ch <- p:
 		return true
 	}
 }
 
-func (s *session) output(data []byte, dst bool) error {
+func (s *session) output(data []byte, dst bool, timeout <-chan struct{}) error {
+	if len(data) > s.config.MaxWriteSize {
+		return errDatagramTooLarge
+	}
+	if len(data) > s.maxDatagramSize(dst) {
+		return s.outputFragments(data, dst, timeout)
+	}
+	return s.outputFrame(frameData, data, dst, timeout)
+}
+
+// outputFrame sends a frame which goes end to end, possibly relayed. It
+// fails with timeoutError once timeout is closed while pacing or queueing.
+func (s *session) outputFrame(typ frameType, data []byte, dst bool, timeout <-chan struct{}) error {
 	if debug {
 		log.Debug().
 			Uint32("sid", s.config.SessionID).
 			Uint32("nid", s.config.NodeID).
+			Stringer("type", typ).
 			Bytes("data", data).
 			Msg("session.output")
 	}
-	ep := s.mostRecentEndpoint(dst)
-	if ep == nil {
+	var scheduled [4]*endpoint
+	eps := s.schedule(dst, s.config.Redundancy, maxHeaderSize+len(data), scheduled[:0])
+	if len(eps) == 0 {
 		if debug {
-			log.Warn().Str("addr", s.srcAddr.String()).Msg("no most recent endpoint")
+			log.Warn().Str("addr", s.srcAddr.String()).Msg("no scheduled endpoint")
 		}
 		return errors.New("no available endpoint to output")
 	}
-	packet := make([]byte, 0, len(data)+sessionIDSize+nodeIDSize)
-	packet = append(packet, data...)
-	packet = append(packet, pooh.Uint322Bytes(s.config.NodeID)...)
+	h := header{
+		typ: typ,
+		sid: s.config.SessionID,
+		nid: s.config.NodeID,
+	}
+	var parity []byte
+	if typ == frameData && s.config.FECGroupSize > 1 {
+		enc := s.fecEncoder(dst)
+		enc.m.Lock()
+		h.flags |= flagSequence | flagFEC
+		h.seq = s.nextSeq()
+		parity = enc.add(h.seq, data, s.config.FECGroupSize)
+		enc.m.Unlock()
+	} else if s.config.Redundancy > 1 {
+		h.flags |= flagSequence
+		h.seq = s.nextSeq()
+	}
+	buf := getBuffer(h.size() + len(data))
+	defer putBuffer(buf)
+	packet := h.marshalTo(*buf, data)
+	var errs *multierror.Error
+	for _, ep := range eps {
+		err := ep.pace(len(packet), timeout)
+		if err == nil {
+			err = ep.send(packet, timeout)
+		}
+		if _, ok := err.(timeoutError); ok {
+			return err
+		}
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	if parity != nil {
+		s.outputParity(parity, dst, timeout)
+	}
+	if errs != nil && len(errs.Errors) == len(eps) {
+		// every copy is lost
+		return errs
+	}
+	return nil
+}
+
+// nextSeq returns the next sequence of redundant mode, which is never zero.
+func (s *session) nextSeq() uint32 {
+	for {
+		if seq := atomic.AddUint32(&s.seq, 1); seq != 0 {
+			return seq
+		}
+	}
+}
+
+// control handles the non-data frames received on ep.
+func (s *session) control(ep *endpoint, h *header, payload []byte) {
+	switch h.typ {
+	case framePing, framePathProbe:
+		if len(payload) >= probeIDSize {
+			// report the frames received on the endpoint as feedback
+			pong := make([]byte, probeIDSize+4)
+			copy(pong, payload[:probeIDSize])
+			binary.BigEndian.PutUint32(pong[probeIDSize:], uint32(ep.RecvCount()))
+			_ = ep.sendFrame(framePong, 0, pong)
+		}
+		if h.typ == framePathProbe && !ep.dst {
+			ep.raiseMTU(h.size() + len(payload))
+		}
+	case framePong:
+		if len(payload) >= probeIDSize {
+			id := binary.BigEndian.Uint32(payload)
+			peerRecv := -1
+			if len(payload) >= probeIDSize+4 {
+				peerRecv = int(binary.BigEndian.Uint32(payload[probeIDSize:]))
+			}
+			ep.probed(id, peerRecv)
+			ep.pathProbed(id)
+		}
+	case frameClose:
+		if h.flags&flagAck != 0 {
+			select {
+			case s.closeAckCh <- struct{}{}:
+			default:
+			}
+			return
+		}
+		_ = ep.sendFrame(frameClose, flagAck, nil)
+		s.closedByPeer(ep.dst)
+	case frameRetire:
+		if h.flags&flagAck != 0 {
+			ep.retireAcked()
+			return
+		}
+		if !ep.dst {
+			// the first frameRetire makes the src endpoint unavailable like
+			// a retiring dst one, the second, sent as the peer closes it,
+			// drops it
+			var retired bool
+			ep.updateHealth(func() {
+				retired = ep.retiring
+				ep.retiring = true
+			})
+			if retired {
+				ep.drop()
+				return
+			}
+			_ = ep.sendFrame(frameRetire, flagAck, nil)
+		}
+	case frameParity:
+		s.fecParity(payload, ep.dst)
+	case frameFragment:
+		s.fragmentInput(payload, ep.dst)
+	case frameStream:
+		if s.relay {
+			_ = s.outputFrame(h.typ, payload, !ep.dst, nil)
+			return
+		}
+		s.streamInput(payload, ep.dst)
+	default:
+		if debug {
+			log.Debug().Uint32("sid", s.config.SessionID).Stringer("type", h.typ).Msg("mdp: unhandled frame")
+		}
+	}
+}
+
+// openStream opens a new stream to the peer on the side of dst. Streams
+// opened by the dst side have odd IDs and those by the src side even IDs,
+// so both sides never pick the same ID.
+func (s *session) openStream(dst bool) (*Stream, error) {
+	s.streamM.Lock()
+	if s.closeOnce.Done() {
+		s.streamM.Unlock()
+		return nil, s.closeError(errStreamClosed)
+	}
+	id := s.streamID + 2
+	if s.streamID == 0 && dst {
+		id = 1
+	}
+	s.streamID = id
+	st := s.addStream(id, dst)
+	s.streamM.Unlock()
+	// announce the stream to the peer, which accepts it
+	st.sendWindow(segWindow)
+	return st, nil
+}
+
+func (s *session) addStream(id uint32, dst bool) *Stream {
+	if s.streams == nil {
+		s.streams = make(map[uint32]*Stream)
+	}
+	st := newStream(s, id, dst)
+	s.streams[id] = st
+	return st
+}
+
+// removeStream forgets the finished stream st.
+func (s *session) removeStream(st *Stream) {
+	s.streamM.Lock()
+	defer s.streamM.Unlock()
+	if s.streams[st.id] != st {
+		return
+	}
+	delete(s.streams, st.id)
+	if s.openedBy(st.id, st.dst) {
+		return
+	}
+	if s.removedIDs == nil {
+		s.removedIDs = make(map[uint32]bool)
+	}
+	s.removedIDs[st.id] = true
+	next := s.removedID + 2
+	if s.removedID == 0 && st.id&1 == 1 {
+		next = 1
+	}
+	for s.removedIDs[next] {
+		delete(s.removedIDs, next)
+		s.removedID = next
+		next += 2
+	}
+}
+
+// openedBy reports whether stream id is opened by the side of dst.
+func (s *session) openedBy(id uint32, dst bool) bool {
+	return (id&1 == 1) == dst
+}
 
-	return ep.send(data)
+// removed reports whether stream id has been removed from the side of dst.
+func (s *session) removed(id uint32, dst bool) bool {
+	if s.openedBy(id, dst) {
+		return id <= s.streamID
+	}
+	return id <= s.removedID || s.removedIDs[id]
+}
+
+// streamInput passes a segment to its stream, an unknown stream is accepted
+// when the peer opens it with a new ID of its side.
+func (s *session) streamInput(p []byte, dst bool) {
+	if len(p) < streamHeaderSize {
+		return
+	}
+	id := binary.BigEndian.Uint32(p)
+	s.streamM.Lock()
+	if s.closeOnce.Done() {
+		s.streamM.Unlock()
+		return
+	}
+	st, ok := s.streams[id]
+	if !ok {
+		if s.removed(id, dst) {
+			s.streamM.Unlock()
+			// retransmission to a removed stream
+			ackRemoved(s, p, dst)
+			return
+		}
+		if s.openedBy(id, dst) || s.acceptCh == nil {
+			s.streamM.Unlock()
+			return
+		}
+		st = s.addStream(id, dst)
+		select {
+		case s.acceptCh <- st:
+		default:
+			// accept queue is full, the peer will retransmit
+			delete(s.streams, id)
+			s.streamM.Unlock()
+			st.release()
+			return
+		}
+	}
+	s.streamM.Unlock()
+	st.input(p)
 }
 
 func (s *session) forward(dst bool) {
@@ -277,7 +855,8 @@ func (s *session) forward(dst bool) {
 			return
 		case p := <-ch:
 			// write to forward endpoints
-			err := s.output(p.Data, !dst)
+			err := s.output(p.Data, !dst, nil)
+			p.release()
 			if debug && err != nil {
 				log.Debug().Err(err).Msg("forward output")
 			}
@@ -285,17 +864,76 @@ func (s *session) forward(dst bool) {
 	}
 }
 
+// shutdown sends frameClose to the peer on every endpoint of the side and
+// waits closeTimeout for its acknowledgement, for closeRetries times.
+func (s *session) shutdown(dst bool) {
+	for i := 0; i < closeRetries; i++ {
+		if s.sendClose(dst) == 0 {
+			return
+		}
+		select {
+		case <-s.closeAckCh:
+			return
+		case <-s.closeOnce.Wait():
+			return
+		case <-time.After(closeTimeout):
+		}
+	}
+}
+
+// sendClose sends frameClose on every connected endpoint of the side,
+// and returns the number of endpoints it was sent on.
+func (s *session) sendClose(dst bool) (n int) {
+	for _, p := range s.paths(dst) {
+		if p.(*endpoint).sendFrame(frameClose, 0, nil) == nil {
+			n++
+		}
+	}
+	return
+}
+
+// closedByPeer closes the session on frameClose from the side of dst,
+// a relaying session passes it on to the other side.
+func (s *session) closedByPeer(dst bool) {
+	if !atomic.CompareAndSwapInt32(&s.peerClosed, 0, 1) {
+		return
+	}
+	if debug {
+		log.Debug().Uint32("sid", s.config.SessionID).Msg("mdp: session is closed by peer")
+	}
+	s.sendClose(!dst)
+	if s.onPeerClose != nil {
+		s.onPeerClose(s)
+	} else {
+		_ = s.Close()
+	}
+}
+
+// closeError returns the error of operations on the closed session.
+func (s *session) closeError(closed error) error {
+	if atomic.LoadInt32(&s.peerClosed) == 1 {
+		return ErrClosedByPeer
+	}
+	return closed
+}
+
 func (s *session) Close() error {
 	return s.closeOnce.Do(func() error {
 		if debug {
 			log.Debug().Uint32("sid", s.config.SessionID).Msg("session.close")
 		}
 		errs := new(multierror.Error)
-		s.srcEndpoints.Range(func(_, v interface{}) bool {
-			ep := v.(*endpoint)
-			errs = multierror.Append(errs, ep.conn.Close())
+		s.streamM.Lock()
+		s.streams = nil
+		s.streamM.Unlock()
+		closeEndpoint := func(_, v interface{}) bool {
+			if conn := v.(*endpoint).getConn(); conn != nil {
+				errs = multierror.Append(errs, conn.Close())
+			}
 			return true
-		})
+		}
+		s.srcEndpoints.Range(closeEndpoint)
+		s.dstEndpoints.Range(closeEndpoint)
 		return errs.ErrorOrNil()
 	})
 }
@@ -0,0 +1,586 @@
+package mdp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	streamHeaderSize = 15
+	// streamSegmentSize is the max payload of a segment
+	streamSegmentSize = 1200
+	// streamWindow is the number of segments in flight and buffered by the receiver
+	streamWindow = 256
+	// streamInterval is the granularity of the RTO
+	streamInterval   = 10 * time.Millisecond
+	streamMinRTO     = 50 * time.Millisecond
+	streamInitRTO    = 300 * time.Millisecond
+	streamMaxRTO     = 5 * time.Second
+	streamFastResend = 2
+	// streamMaxRetransmits fails the stream when a segment is not acknowledged
+	// after that many RTO
+	streamMaxRetransmits = 20
+)
+
+// segment commands
+const (
+	segPush byte = iota
+	segAck
+	segFin
+	// segWindowAsk probes the zero window of the peer
+	segWindowAsk
+	// segWindow tells the window of the receiver
+	segWindow
+)
+
+var (
+	errStreamClosed  = errors.New("mdp: stream is closed")
+	errStreamTimeout = errors.New("mdp: stream retransmission timeout")
+)
+
+var _ net.Conn = &Stream{}
+
+// Stream is a reliable ordered byte stream multiplexed over a session,
+// segments are acknowledged selectively and retransmitted by per segment RTO
+// or fast resend, and the sender is flow controlled by the window of the
+// receiver.
+//
+// The segment header is id[4] cmd[1] sn[4] una[4] wnd[2], una is the next sn
+// the sender of the segment expects and wnd its free receive window in
+// segments.
+type Stream struct {
+	sess  *session
+	id    uint32
+	dst   bool
+	local net.Addr
+	m     sync.Mutex
+	// send
+	sndNext  uint32
+	sndUna   uint32
+	sndQueue []*streamSegment // waiting for the window
+	sndBuf   []*streamSegment // in flight, ordered by sn
+	rmtWnd   uint16
+	askAt    time.Time
+	srtt     time.Duration
+	rttVar   time.Duration
+	rto      time.Duration
+	finSent  bool
+	closed   bool
+	// receive
+	rcvNext  uint32
+	rcvBuf   map[uint32]*streamSegment
+	rcvQueue bytes.Buffer
+	rcvFin   bool
+	zeroWnd  bool // the advertised window was zero
+	// acks and windowDue are answered by the loop, so the read path of the
+	// session never blocks on sending
+	acks      []uint32
+	windowDue bool
+	err       error
+
+	readEvent     chan struct{}
+	writeEvent    chan struct{}
+	flushEvent    chan struct{}
+	readDeadline  *deadline
+	writeDeadline *deadline
+	done          chan struct{}
+	releaseOnce   sync.Once
+}
+
+type streamSegment struct {
+	cmd    byte
+	sn     uint32
+	data   []byte
+	sentAt time.Time
+	resend time.Time
+	rto    time.Duration
+	xmit   int
+	skips  int
+	// timeouts counts the retransmissions by RTO, which fail the stream
+	timeouts int
+}
+
+func newStream(sess *session, id uint32, dst bool) *Stream {
+	st := &Stream{
+		sess:          sess,
+		id:            id,
+		dst:           dst,
+		rmtWnd:        streamWindow,
+		rto:           streamInitRTO,
+		rcvBuf:        make(map[uint32]*streamSegment),
+		readEvent:     make(chan struct{}, 1),
+		writeEvent:    make(chan struct{}, 1),
+		flushEvent:    make(chan struct{}, 1),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		done:          make(chan struct{}),
+	}
+	go st.loop()
+	return st
+}
+
+// before reports whether sequence number a is before b.
+func before(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) Read(b []byte) (n int, err error) {
+	for {
+		st.m.Lock()
+		if st.rcvQueue.Len() > 0 {
+			n, _ = st.rcvQueue.Read(b)
+			update := st.zeroWnd && st.window() > 0
+			st.m.Unlock()
+			if update {
+				st.sendWindow(segWindow)
+			}
+			return
+		}
+		switch {
+		case st.rcvFin:
+			err = io.EOF
+		case st.err != nil:
+			err = st.err
+		case st.closed:
+			err = errStreamClosed
+		}
+		st.m.Unlock()
+		if err != nil {
+			return
+		}
+		select {
+		case <-st.readEvent:
+		case <-st.sess.closeOnce.Wait():
+			return 0, st.sess.closeError(errStreamClosed)
+		case <-st.readDeadline.wait():
+			return 0, timeoutError{}
+		}
+	}
+}
+
+// Write blocks while the send queue is full.
+func (st *Stream) Write(b []byte) (n int, err error) {
+	for n < len(b) {
+		st.m.Lock()
+		switch {
+		case st.err != nil:
+			err = st.err
+		case st.finSent:
+			err = errStreamClosed
+		}
+		if err != nil {
+			st.m.Unlock()
+			return
+		}
+		for len(st.sndQueue) < streamWindow && n < len(b) {
+			size := len(b) - n
+			if size > streamSegmentSize {
+				size = streamSegmentSize
+			}
+			st.queue(segPush, append([]byte(nil), b[n:n+size]...))
+			n += size
+		}
+		st.m.Unlock()
+		notify(st.flushEvent)
+		if n == len(b) {
+			return
+		}
+		select {
+		case <-st.writeEvent:
+		case <-st.sess.closeOnce.Wait():
+			return n, st.sess.closeError(errStreamClosed)
+		case <-st.writeDeadline.wait():
+			return n, timeoutError{}
+		}
+	}
+	return
+}
+
+// Close sends a FIN after the written data without waiting for it to be
+// acknowledged, the peer reads io.EOF then.
+func (st *Stream) Close() error {
+	return st.close(true)
+}
+
+// CloseWrite sends a FIN like Close but keeps reading from the peer.
+func (st *Stream) CloseWrite() error {
+	return st.close(false)
+}
+
+func (st *Stream) close(read bool) error {
+	st.m.Lock()
+	if read {
+		st.closed = true
+	}
+	if st.finSent {
+		st.m.Unlock()
+		notify(st.readEvent)
+		return nil
+	}
+	st.finSent = true
+	if st.err == nil {
+		st.queue(segFin, nil)
+	}
+	st.m.Unlock()
+	notify(st.readEvent)
+	notify(st.writeEvent)
+	notify(st.flushEvent)
+	return nil
+}
+
+func (st *Stream) queue(cmd byte, data []byte) {
+	st.sndQueue = append(st.sndQueue, &streamSegment{
+		cmd:  cmd,
+		sn:   st.sndNext,
+		data: data,
+	})
+	st.sndNext++
+}
+
+// ID returns the ID of the stream, which is unique within its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	if st.dst {
+		return st.sess.srcAddr
+	}
+	return st.local
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	if st.dst {
+		return st.sess.dstAddr
+	}
+	return st.sess.srcAddr
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	st.writeDeadline.set(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.writeDeadline.set(t)
+	return nil
+}
+
+// window returns the free receive window in segments.
+func (st *Stream) window() uint16 {
+	used := len(st.rcvBuf) + (st.rcvQueue.Len()+streamSegmentSize-1)/streamSegmentSize
+	if used >= streamWindow {
+		return 0
+	}
+	return uint16(streamWindow - used)
+}
+
+// output sends a segment, st.m must not be held.
+func (st *Stream) output(cmd byte, sn, una uint32, wnd uint16, data []byte) {
+	outputSegment(st.sess, st.dst, st.id, cmd, sn, una, wnd, data)
+}
+
+func outputSegment(sess *session, dst bool, id uint32, cmd byte, sn, una uint32, wnd uint16, data []byte) {
+	p := make([]byte, streamHeaderSize+len(data))
+	binary.BigEndian.PutUint32(p, id)
+	p[4] = cmd
+	binary.BigEndian.PutUint32(p[5:], sn)
+	binary.BigEndian.PutUint32(p[9:], una)
+	binary.BigEndian.PutUint16(p[13:], wnd)
+	copy(p[streamHeaderSize:], data)
+	_ = sess.outputFrame(frameStream, p, dst, nil)
+}
+
+// ackRemoved acknowledges a retransmitted segment p of a removed stream,
+// which has received everything up to its FIN.
+func ackRemoved(sess *session, p []byte, dst bool) {
+	if cmd := p[4]; cmd != segPush && cmd != segFin {
+		return
+	}
+	sn := binary.BigEndian.Uint32(p[5:])
+	outputSegment(sess, dst, binary.BigEndian.Uint32(p), segAck, sn, sn+1, streamWindow, nil)
+}
+
+func (st *Stream) sendWindow(cmd byte) {
+	st.m.Lock()
+	una, wnd := st.rcvNext, st.window()
+	st.zeroWnd = wnd == 0
+	st.m.Unlock()
+	st.output(cmd, 0, una, wnd, nil)
+}
+
+// input handles a segment from the peer.
+func (st *Stream) input(p []byte) {
+	cmd := p[4]
+	sn := binary.BigEndian.Uint32(p[5:])
+	una := binary.BigEndian.Uint32(p[9:])
+	wnd := binary.BigEndian.Uint16(p[13:])
+	data := p[streamHeaderSize:]
+
+	st.m.Lock()
+	st.rmtWnd = wnd
+	st.acked(una)
+	switch cmd {
+	case segAck:
+		st.ackedSegment(sn)
+	case segPush, segFin:
+		if before(sn, st.rcvNext+streamWindow) && !before(sn, st.rcvNext) {
+			if _, ok := st.rcvBuf[sn]; !ok {
+				st.rcvBuf[sn] = &streamSegment{
+					cmd:  cmd,
+					sn:   sn,
+					data: append([]byte(nil), data...),
+				}
+			}
+			st.reassemble()
+		}
+		st.acks = append(st.acks, sn)
+	case segWindowAsk:
+		st.windowDue = true
+	}
+	st.m.Unlock()
+	notify(st.flushEvent)
+}
+
+// answer sends the acknowledgements and window updates due.
+func (st *Stream) answer() {
+	st.m.Lock()
+	acks, windowDue := st.acks, st.windowDue
+	st.acks, st.windowDue = nil, false
+	una, wnd := st.rcvNext, st.window()
+	if len(acks) > 0 {
+		st.zeroWnd = wnd == 0
+	}
+	st.m.Unlock()
+	for _, sn := range acks {
+		st.output(segAck, sn, una, wnd, nil)
+	}
+	if windowDue {
+		st.sendWindow(segWindow)
+	}
+}
+
+// reassemble moves the in order segments to the read queue.
+func (st *Stream) reassemble() {
+	for {
+		seg, ok := st.rcvBuf[st.rcvNext]
+		if !ok {
+			return
+		}
+		delete(st.rcvBuf, st.rcvNext)
+		st.rcvNext++
+		if seg.cmd == segFin {
+			st.rcvFin = true
+		} else {
+			st.rcvQueue.Write(seg.data)
+		}
+		notify(st.readEvent)
+	}
+}
+
+// acked removes the segments before una from the send buffer.
+func (st *Stream) acked(una uint32) {
+	i := 0
+	for ; i < len(st.sndBuf) && before(st.sndBuf[i].sn, una); i++ {
+	}
+	if i > 0 {
+		st.sndBuf = st.sndBuf[i:]
+		notify(st.writeEvent)
+	}
+	if before(st.sndUna, una) {
+		st.sndUna = una
+	}
+}
+
+// ackedSegment removes segment sn from the send buffer, segments before it
+// are skipped for fast resend.
+func (st *Stream) ackedSegment(sn uint32) {
+	for i, seg := range st.sndBuf {
+		if seg.sn == sn {
+			if seg.xmit == 1 {
+				// Karn's algorithm
+				st.updateRTO(time.Since(seg.sentAt))
+			}
+			st.sndBuf = append(st.sndBuf[:i], st.sndBuf[i+1:]...)
+			notify(st.writeEvent)
+			return
+		}
+		if before(seg.sn, sn) {
+			seg.skips++
+		}
+	}
+}
+
+// updateRTO follows RFC 6298.
+func (st *Stream) updateRTO(rtt time.Duration) {
+	if st.srtt == 0 {
+		st.srtt = rtt
+		st.rttVar = rtt / 2
+	} else {
+		st.rttVar = (3*st.rttVar + abs(st.srtt-rtt)) / 4
+		st.srtt = (7*st.srtt + rtt) / 8
+	}
+	variance := 4 * st.rttVar
+	if variance < streamInterval {
+		variance = streamInterval
+	}
+	st.rto = clampRTO(st.srtt + variance)
+}
+
+func clampRTO(rto time.Duration) time.Duration {
+	if rto < streamMinRTO {
+		return streamMinRTO
+	}
+	if rto > streamMaxRTO {
+		return streamMaxRTO
+	}
+	return rto
+}
+
+// flush moves queued segments into the remote window and (re)sends the due
+// segments of the send buffer. It returns when the next retransmission or
+// window probe is due, or the zero time if none is.
+func (st *Stream) flush() (next time.Time) {
+	now := time.Now()
+	var out []*streamSegment
+	st.m.Lock()
+	if st.err != nil {
+		st.m.Unlock()
+		return
+	}
+	for len(st.sndQueue) > 0 && len(st.sndBuf) < int(st.rmtWnd) && len(st.sndBuf) < streamWindow {
+		seg := st.sndQueue[0]
+		st.sndQueue = st.sndQueue[1:]
+		st.sndBuf = append(st.sndBuf, seg)
+		notify(st.writeEvent)
+	}
+	for _, seg := range st.sndBuf {
+		switch {
+		case seg.xmit == 0:
+			seg.rto = st.rto
+		case seg.skips >= streamFastResend:
+			seg.skips = 0
+		case !now.Before(seg.resend):
+			seg.rto = clampRTO(seg.rto * 2)
+			seg.timeouts++
+		default:
+			continue
+		}
+		if seg.timeouts > streamMaxRetransmits {
+			st.fail(errStreamTimeout)
+			st.m.Unlock()
+			return time.Time{}
+		}
+		seg.xmit++
+		seg.sentAt = now
+		seg.resend = now.Add(seg.rto)
+		out = append(out, seg)
+	}
+	ask := st.rmtWnd == 0 && len(st.sndQueue) > 0 && now.Sub(st.askAt) >= st.rto
+	if ask {
+		st.askAt = now
+	}
+	for _, seg := range st.sndBuf {
+		if next.IsZero() || seg.resend.Before(next) {
+			next = seg.resend
+		}
+	}
+	if st.rmtWnd == 0 && len(st.sndQueue) > 0 {
+		if at := st.askAt.Add(st.rto); next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	una, wnd := st.rcvNext, st.window()
+	st.m.Unlock()
+
+	for _, seg := range out {
+		st.output(seg.cmd, seg.sn, una, wnd, seg.data)
+	}
+	if ask {
+		st.output(segWindowAsk, 0, una, wnd, nil)
+	}
+	return
+}
+
+func (st *Stream) fail(err error) {
+	st.err = err
+	st.sndQueue = nil
+	st.sndBuf = nil
+	notify(st.readEvent)
+	notify(st.writeEvent)
+}
+
+// finished reports whether both sides have closed and everything is
+// acknowledged, or the stream has failed.
+func (st *Stream) finished() bool {
+	st.m.Lock()
+	defer st.m.Unlock()
+	return st.err != nil || st.rcvFin && st.finSent && len(st.sndQueue) == 0 && len(st.sndBuf) == 0
+}
+
+// release removes the stream from its session and stops its loop.
+func (st *Stream) release() {
+	st.releaseOnce.Do(func() {
+		close(st.done)
+		st.sess.removeStream(st)
+	})
+}
+
+// loop sends and retransmits until the stream is finished or the session is
+// closed. Its timer is only armed while a retransmission or window probe is
+// due, so idle streams cost nothing.
+func (st *Stream) loop() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+	armed := false
+	for {
+		select {
+		case <-st.done:
+			return
+		case <-st.sess.closeOnce.Wait():
+			st.m.Lock()
+			if st.err == nil {
+				st.fail(st.sess.closeError(errStreamClosed))
+			}
+			st.m.Unlock()
+			return
+		case <-st.flushEvent:
+			st.answer()
+		case <-timer.C:
+			armed = false
+		}
+		if st.finished() {
+			// such as the acknowledgement of the FIN of the peer
+			st.answer()
+			st.release()
+			return
+		}
+		next := st.flush()
+		if armed && !timer.Stop() {
+			<-timer.C
+		}
+		armed = !next.IsZero()
+		if armed {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package mdp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func echoStream(server *Server) {
+	for {
+		st, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, _ = io.Copy(st, st)
+			_ = st.Close()
+		}()
+	}
+}
+
+func dialStream(t *require.Assertions, config Config) (*Server, *Client) {
+	port := freePort(t)
+	server, err := Listen(ServerConfig{
+		Port:         port,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+
+	config.IP4 = net.IPv4(127, 0, 0, 1)
+	config.Port = port
+	config.DisableICMDP = true
+	client, err := NewClient(config)
+	t.NoError(err)
+	return server, client
+}
+
+// roundTrip writes size random bytes to the echoing st and reads them back.
+func roundTrip(st *Stream, size int) error {
+	if err := st.SetDeadline(time.Now().Add(20 * time.Second)); err != nil {
+		return err
+	}
+	data := make([]byte, size)
+	rand.Read(data)
+	go func() {
+		_, _ = st.Write(data)
+		_ = st.CloseWrite()
+	}()
+	received, err := io.ReadAll(st)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, received) {
+		return fmt.Errorf("stream %d received %d of %d bytes", st.ID(), len(received), len(data))
+	}
+	return nil
+}
+
+func testStream(t *require.Assertions, config Config, streams, size int) {
+	server, client := dialStream(t, config)
+	defer server.Close()
+	defer client.Close()
+	go echoStream(server)
+
+	errs := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		st, err := client.OpenStream()
+		t.NoError(err)
+		t.Equal(uint32(2*i+1), st.ID())
+		go func() {
+			errs <- roundTrip(st, size)
+		}()
+	}
+	for i := 0; i < streams; i++ {
+		t.NoError(<-errs)
+	}
+
+	// finished streams are removed from both sides
+	time.Sleep(100 * time.Millisecond)
+	client.sess.streamM.Lock()
+	t.Empty(client.sess.streams)
+	client.sess.streamM.Unlock()
+}
+
+func TestStream(tt *testing.T) {
+	testStream(require.New(tt), Config{}, 1, 1<<20)
+}
+
+func TestStreamLossy(tt *testing.T) {
+	testStream(require.New(tt), Config{
+		DisableTCP: true,
+		Obfuscator: testObfuscator{drop: dropRandom(0.1)},
+	}, 1, 256<<10)
+}
+
+func TestStreamMultiplex(tt *testing.T) {
+	testStream(require.New(tt), Config{}, 8, 128<<10)
+}
+
+func TestStreamIdle(tt *testing.T) {
+	t := require.New(tt)
+	server, client := dialStream(t, Config{})
+	defer server.Close()
+	defer client.Close()
+	go echoStream(server)
+
+	st, err := client.OpenStream()
+	t.NoError(err)
+	_, err = st.Write([]byte("hello"))
+	t.NoError(err)
+	t.NoError(st.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = st.Read(make([]byte, 10))
+	t.NoError(err)
+
+	// nothing is due once everything written is acknowledged
+	t.Eventually(func() bool {
+		return st.flush().IsZero()
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestStreamOpenByServer(tt *testing.T) {
+	t := require.New(tt)
+	server, client := dialStream(t, Config{})
+	defer server.Close()
+	defer client.Close()
+
+	// the server needs the session address, which the client's first stream gives
+	st, err := client.OpenStream()
+	t.NoError(err)
+	_, err = st.Write([]byte("hello"))
+	t.NoError(err)
+	accepted, err := server.AcceptStream()
+	t.NoError(err)
+
+	opened, err := server.OpenStream(accepted.RemoteAddr())
+	t.NoError(err)
+	t.Equal(uint32(2), opened.ID())
+	go func() {
+		_, _ = io.Copy(opened, opened)
+		_ = opened.Close()
+	}()
+	st, err = client.AcceptStream()
+	t.NoError(err)
+	t.Equal(uint32(2), st.ID())
+	t.NoError(roundTrip(st, 64<<10))
+}
+
+func TestStreamRelay(tt *testing.T) {
+	t := require.New(tt)
+	port := freePort(t)
+	node, err := Listen(ServerConfig{
+		Port:         port,
+		NodeID:       2,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer node.Close()
+	go echoStream(node)
+
+	relayPort := freePort(t)
+	relay, err := Listen(ServerConfig{
+		Port:         relayPort,
+		NodeID:       1,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer relay.Close()
+	relay.SetForwardNode(2, DualStackAddr{IP4: net.IPv4(127, 0, 0, 1), Port: port})
+
+	// the stream to node 2 passes the relay
+	client, err := NewClient(Config{
+		IP4:          net.IPv4(127, 0, 0, 1),
+		Port:         relayPort,
+		NodeID:       2,
+		DisableICMDP: true,
+	})
+	t.NoError(err)
+	defer client.Close()
+	st, err := client.OpenStream()
+	t.NoError(err)
+	t.NoError(roundTrip(st, 100<<10))
+}